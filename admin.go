@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SourceStatus describes a source and its ring buffer, as reported
+// by the admin API.
+type SourceStatus struct {
+	Key        string         `json:"key"`
+	Label      string         `json:"label"`
+	Pid        int            `json:"pid,omitempty"`
+	Open       bool           `json:"open"`
+	Input      string         `json:"input"`              // input in use
+	Fallback   bool           `json:"fallback"`           // input is a -fallback
+	Metadata   *Metadata      `json:"metadata,omitempty"` // see -tag-metadata
+	Failed     bool           `json:"failed"`             // see -restart-fail-count
+	BytesIn    uint64         `json:"bytes_in"`
+	BytesOut   uint64         `json:"bytes_out"`
+	Uptime     float64        `json:"uptime_seconds"`
+	NextFrame  uint64         `json:"next_frame"`
+	BufFrames  int            `json:"buffer_frames"`
+	FirstFrame uint64         `json:"first_frame"` // oldest frame still in the buffer
+	WritePos   uint64         `json:"write_pos"`   // ring slot of NextFrame
+	Clients    []ClientStatus `json:"clients"`
+}
+
+// ClientStatus describes a connected client, as reported by the admin
+// API.
+type ClientStatus struct {
+	ID            uint64  `json:"id"`
+	Client        string  `json:"client"`
+	BytesRead     uint64  `json:"bytes"`
+	FramesRead    uint64  `json:"frames"`
+	FramesSkipped uint64  `json:"skipped"`
+	NextFrame     uint64  `json:"next_frame"`
+	Lag           uint64  `json:"lag"`
+	Elapsed       float64 `json:"elapsed_seconds"`
+}
+
+// Status returns the current state of the source, its ring buffer,
+// and its clients.
+func (s *Source) Status() SourceStatus {
+	next := atomic.LoadUint64(&s.nextFrame)
+	st := SourceStatus{
+		Key:       s.key,
+		Label:     s.label,
+		BytesIn:   atomic.LoadUint64(&s.statBytesIn),
+		BytesOut:  atomic.LoadUint64(&s.statBytesOut),
+		Uptime:    time.Since(s.startTime).Seconds(),
+		NextFrame: next,
+		BufFrames: s.ring.Len(),
+		WritePos:  next % uint64(s.ring.Len()),
+		Clients:   []ClientStatus{},
+	}
+	if next > uint64(s.ring.Len()) {
+		st.FirstFrame = next - uint64(s.ring.Len())
+	}
+	s.inputLock.Lock()
+	st.Open = s.input != nil
+	st.Input = s.inputs[s.current].label
+	st.Fallback = s.current > 0
+	st.Metadata = s.metadata.Load()
+	st.Failed = s.isFailed()
+	if s.cmd != nil && s.cmd.Process != nil {
+		st.Pid = s.cmd.Process.Pid
+	}
+	s.inputLock.Unlock()
+	s.readersLock.Lock()
+	for sr := range s.readers {
+		st.Clients = append(st.Clients, ClientStatus{
+			ID:            sr.ID,
+			Client:        sr.client,
+			BytesRead:     atomic.LoadUint64(&sr.BytesRead),
+			FramesRead:    atomic.LoadUint64(&sr.FramesRead),
+			FramesSkipped: atomic.LoadUint64(&sr.FramesSkipped),
+			NextFrame:     atomic.LoadUint64(&sr.nextFrame),
+			Lag:           sr.Lag(),
+			Elapsed:       time.Since(sr.startTime).Seconds(),
+		})
+	}
+	s.readersLock.Unlock()
+	sort.Slice(st.Clients, func(i, j int) bool { return st.Clients[i].ID < st.Clients[j].ID })
+	return st
+}
+
+// ErrNotExec is returned when restarting a source that does not run
+// a child process.
+var ErrNotExec = errors.New("source does not run a child process")
+
+// Reopen closes the source's input (killing its child process, if
+// any) and makes the source reopen it, even if -reopen=false.
+func (s *Source) Reopen() {
+	atomic.StoreInt32(&s.forceReopen, 1)
+	s.closeInput()
+}
+
+// reopenForced returns true if Reopen was called, and the input
+// hasn't been reopened since.
+func (s *Source) reopenForced() bool {
+	return atomic.LoadInt32(&s.forceReopen) != 0
+}
+
+// Restart kills the source's child process and starts a new one.
+func (s *Source) Restart() error {
+	s.inputLock.Lock()
+	isExec := len(s.inputs[s.current].execArgs) > 0
+	s.inputLock.Unlock()
+	if !isExec {
+		return ErrNotExec
+	}
+	s.Reopen()
+	return nil
+}
+
+// Status returns the status of every open source.
+func (sm *SourceMap) Status() []SourceStatus {
+	sm.mutex.RLock()
+	sts := make([]SourceStatus, 0, len(sm.sources))
+	for _, src := range sm.sources {
+		sts = append(sts, src.Status())
+	}
+	sm.mutex.RUnlock()
+	sort.Slice(sts, func(i, j int) bool { return sts[i].Key < sts[j].Key })
+	return sts
+}
+
+// Source returns the open source with the given key, or nil.
+func (sm *SourceMap) Source(key string) *Source {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.sources[key]
+}
+
+// Kick disconnects the client with the given ID. It returns false if
+// there is no such client.
+func (sm *SourceMap) Kick(id uint64) bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, src := range sm.sources {
+		src.readersLock.Lock()
+		for sr := range src.readers {
+			if sr.ID == id {
+				src.readersLock.Unlock()
+				sr.Kick()
+				return true
+			}
+		}
+		src.readersLock.Unlock()
+	}
+	return false
+}
+
+// adminHandler serves the admin API under the given path prefix.
+// Every request must carry the admin token as a bearer token.
+type adminHandler struct {
+	prefix    string
+	token     string
+	sourceMap *SourceMap
+}
+
+func newAdminHandler(prefix, tokenFile string, sm *SourceMap) (*adminHandler, error) {
+	buf, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return nil, errors.New("admin token file " + tokenFile + " is empty")
+	}
+	return &adminHandler{prefix: strings.TrimSuffix(prefix, "/"), token: token, sourceMap: sm}, nil
+}
+
+func (ah *adminHandler) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+ah.token)) != 1 {
+		ah.reply(writer, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	op := strings.TrimPrefix(req.URL.Path, ah.prefix)
+	if op == "/sources" {
+		if req.Method != "GET" {
+			ah.reply(writer, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+			return
+		}
+		ah.reply(writer, http.StatusOK, ah.sourceMap.Status())
+		return
+	}
+	if req.Method != "POST" {
+		ah.reply(writer, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+	switch op {
+	case "/kick":
+		id, err := strconv.ParseUint(req.FormValue("client"), 10, 64)
+		if err != nil {
+			ah.reply(writer, http.StatusBadRequest, map[string]string{"error": "invalid client id"})
+		} else if !ah.sourceMap.Kick(id) {
+			ah.reply(writer, http.StatusNotFound, map[string]string{"error": "no such client"})
+		} else {
+			log.Printf("admin %s: kick client %d", req.RemoteAddr, id)
+			ah.reply(writer, http.StatusOK, map[string]uint64{"kicked": id})
+		}
+	case "/reopen", "/restart":
+		key := req.FormValue("source")
+		src := ah.sourceMap.Source(key)
+		if src == nil {
+			ah.reply(writer, http.StatusNotFound, map[string]string{"error": "no such source"})
+			return
+		}
+		log.Printf("admin %s: %s source %s", req.RemoteAddr, op[1:], src.label)
+		if op == "/reopen" {
+			src.Reopen()
+		} else if err := src.Restart(); err != nil {
+			ah.reply(writer, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		ah.reply(writer, http.StatusOK, map[string]string{op[1:]: key})
+	default:
+		ah.reply(writer, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+func (ah *adminHandler) reply(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	enc := json.NewEncoder(writer)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin: error writing response: %s", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method, url, token string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestAdminAPI(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		FrameBytes:      16,
+		Path:            "/dev/zero",
+		Reopen:          true,
+		SourceBandwidth: 16000,
+		SourceBuffer:    4,
+		AdminPath:       "/admin",
+		AdminTokenFile:  tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	base := fmt.Sprintf("http://%s/admin", srv.Addr)
+
+	if code, _ := adminRequest(t, "GET", base+"/sources", ""); code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", code)
+	}
+	if code, _ := adminRequest(t, "GET", base+"/sources", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", code)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadFull(resp.Body, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := adminRequest(t, "GET", base+"/sources", "s3cret")
+	if code != http.StatusOK {
+		t.Fatalf("sources: got %d %s", code, body)
+	}
+	var sts []SourceStatus
+	if err := json.Unmarshal(body, &sts); err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 1 || len(sts[0].Clients) != 1 || sts[0].BufFrames != 4 {
+		t.Fatalf("unexpected status %s", body)
+	}
+
+	if code, body := adminRequest(t, "POST", base+"/restart?source=/dev/zero", "s3cret"); code != http.StatusBadRequest {
+		t.Errorf("restart non-exec source: got %d %s", code, body)
+	}
+	if code, body := adminRequest(t, "POST", base+"/reopen?source=/dev/zero", "s3cret"); code != http.StatusOK {
+		t.Errorf("reopen: got %d %s", code, body)
+	}
+	if code, body := adminRequest(t, "POST", base+"/kick?client=0", "s3cret"); code != http.StatusNotFound {
+		t.Errorf("kick nonexistent client: got %d %s", code, body)
+	}
+	kick := fmt.Sprintf("%s/kick?client=%d", base, sts[0].Clients[0].ID)
+	if code, body := adminRequest(t, "POST", kick, "s3cret"); code != http.StatusOK {
+		t.Errorf("kick: got %d %s", code, body)
+	}
+	done := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("kicked client still connected after 1s")
+	}
+}
+
+func TestAdminRequiresTokenFile(t *testing.T) {
+	c := Config{SourceBuffer: 3, FrameBytes: 1, Path: "/dev/stdin", AdminPath: "/admin"}
+	if c.Check() == nil {
+		t.Error("-admin-path without -admin-token-file accepted")
+	}
+	c.AdminTokenFile = os.DevNull
+	if err := c.Check(); err != nil {
+		t.Error(err)
+	}
+}
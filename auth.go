@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSessionExpired is returned by Read when the client's session
+// has reached its maximum duration.
+var ErrSessionExpired = errors.New("session expired")
+
+// AuthKeys is the format of the file given by -auth-key-file.
+//
+// Secret is used to check HMAC-signed URLs. Each token in Tokens can
+// be given as a bearer token. If a token has Paths, it can only be
+// used for those URI paths. If it has MaxSession (e.g., "1h") or
+// MaxStreamTime, they override -client-max-duration and
+// -client-max-stream-time for its clients.
+type AuthKeys struct {
+	Secret string      `json:"secret"`
+	Tokens []AuthToken `json:"tokens"`
+	// tokens, by sha256 hash of the token, so looking up a token
+	// doesn't leak timing information about valid tokens
+	byHash map[string]*AuthToken
+}
+
+// AuthToken is a bearer token listed in an AuthKeys file.
+type AuthToken struct {
+	Token         string   `json:"token"`
+	Paths         []string `json:"paths"`
+	MaxSession    string   `json:"max-session"`
+	MaxStreamTime string   `json:"max-stream-time"`
+	limits        clientLimits
+}
+
+// An authError explains why a client was refused.
+type authError struct {
+	status int // HTTP response status
+	msg    string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// loadAuthKeys reads and checks the given key file.
+func loadAuthKeys(filename string) (*AuthKeys, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := &AuthKeys{}
+	if err := json.Unmarshal(buf, keys); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	keys.byHash = make(map[string]*AuthToken)
+	for i := range keys.Tokens {
+		tok := &keys.Tokens[i]
+		if tok.Token == "" {
+			return nil, fmt.Errorf("%s: token %d is empty", filename, i)
+		}
+		if tok.MaxSession != "" {
+			if tok.limits.maxDuration, err = time.ParseDuration(tok.MaxSession); err != nil {
+				return nil, fmt.Errorf("%s: token %d: max-session: %s", filename, i, err)
+			}
+		}
+		if tok.MaxStreamTime != "" {
+			if tok.limits.maxStreamTime, err = time.ParseDuration(tok.MaxStreamTime); err != nil {
+				return nil, fmt.Errorf("%s: token %d: max-stream-time: %s", filename, i, err)
+			}
+		}
+		keys.byHash[tokenHash(tok.Token)] = tok
+	}
+	return keys, nil
+}
+
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// SignURL returns the "sig" query parameter for a signed URL for
+// the given path, expiry time (unix timestamp), and maximum session
+// duration (which can be empty).
+func (keys *AuthKeys) SignURL(path, exp, dur string) string {
+	mac := hmac.New(sha256.New, []byte(keys.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s", path, exp, dur)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorize checks the request's bearer token or signed URL. It
+// returns the client limits given by the token or URL (including a
+// signed URL's expiry time, which ends the session), or an error if
+// the client should be refused.
+func (keys *AuthKeys) authorize(req *http.Request, now time.Time) (limits clientLimits, err error) {
+	if keys == nil {
+		return clientLimits{}, &authError{http.StatusForbidden, "authentication is not configured"}
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return clientLimits{}, &authError{http.StatusUnauthorized, "unsupported authorization type"}
+		}
+		tok := keys.byHash[tokenHash(strings.TrimPrefix(auth, "Bearer "))]
+		if tok == nil {
+			return clientLimits{}, &authError{http.StatusForbidden, "invalid token"}
+		}
+		if len(tok.Paths) > 0 {
+			ok := false
+			for _, p := range tok.Paths {
+				ok = ok || p == req.URL.Path
+			}
+			if !ok {
+				return clientLimits{}, &authError{http.StatusForbidden, "token is not valid for " + req.URL.Path}
+			}
+		}
+		return tok.limits, nil
+	}
+	q := req.URL.Query()
+	sig, exp, dur := q.Get("sig"), q.Get("exp"), q.Get("dur")
+	if sig == "" {
+		return clientLimits{}, &authError{http.StatusUnauthorized, "no token or signature"}
+	}
+	if keys.Secret == "" {
+		return clientLimits{}, &authError{http.StatusForbidden, "signed URLs are not enabled"}
+	}
+	if !hmac.Equal([]byte(sig), []byte(keys.SignURL(req.URL.Path, exp, dur))) {
+		return clientLimits{}, &authError{http.StatusForbidden, "invalid signature"}
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return clientLimits{}, &authError{http.StatusForbidden, "invalid exp"}
+	}
+	if now.Unix() > expUnix {
+		return clientLimits{}, &authError{http.StatusForbidden, "signed URL expired"}
+	}
+	limits.expires = time.Unix(expUnix, 0)
+	if dur != "" {
+		if limits.maxDuration, err = time.ParseDuration(dur); err != nil {
+			return clientLimits{}, &authError{http.StatusForbidden, "invalid dur"}
+		}
+	}
+	return limits, nil
+}
+
+// loadAuthKeys (re)loads the server's -auth-key-file.
+func (srv *Server) loadAuthKeys() error {
+	keys, err := loadAuthKeys(srv.config.AuthKeyFile)
+	if err != nil {
+		return err
+	}
+	srv.authKeys.Store(keys)
+	log.Printf("loaded %d tokens from %s", len(keys.Tokens), srv.config.AuthKeyFile)
+	return nil
+}
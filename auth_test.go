@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeAuthKeys(t *testing.T, content string) string {
+	return writeTestFile(t, []byte(content))
+}
+
+func TestAuthorize(t *testing.T) {
+	fn := writeAuthKeys(t, `{"secret":"s3cret","tokens":[
+		{"token":"any"},
+		{"token":"radio","paths":["/radio.mp3"],"max-session":"1h"}]}`)
+	keys, err := loadAuthKeys(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	sig := keys.SignURL("/radio.mp3", "1500000100", "30m")
+	for _, trial := range []struct {
+		path    string
+		query   string
+		bearer  string
+		status  int
+		session time.Duration
+	}{
+		{"/radio.mp3", "", "any", 0, 0},
+		{"/radio.mp3", "", "radio", 0, time.Hour},
+		{"/pcm", "", "radio", http.StatusForbidden, 0},
+		{"/pcm", "", "bogus", http.StatusForbidden, 0},
+		{"/pcm", "", "", http.StatusUnauthorized, 0},
+		{"/radio.mp3", "exp=1500000100&dur=30m&sig=" + sig, "", 0, 30 * time.Minute},
+		{"/radio.mp3", "exp=1500000100&dur=1h&sig=" + sig, "", http.StatusForbidden, 0},
+		{"/radio.mp3", "exp=1500000200&dur=30m&sig=" + sig, "", http.StatusForbidden, 0},
+		{"/pcm", "exp=1500000100&dur=30m&sig=" + sig, "", http.StatusForbidden, 0},
+		{"/radio.mp3", "exp=1499999999&sig=" + keys.SignURL("/radio.mp3", "1499999999", ""), "", http.StatusForbidden, 0},
+		{"/radio.mp3", "exp=1500000100&sig=" + keys.SignURL("/radio.mp3", "1500000100", ""), "", 0, 0},
+	} {
+		req := &http.Request{
+			URL:    &url.URL{Path: trial.path, RawQuery: trial.query},
+			Header: http.Header{},
+		}
+		if trial.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+trial.bearer)
+		}
+		limits, err := keys.authorize(req, now)
+		if trial.status == 0 && err != nil {
+			t.Errorf("%+v: unexpected error %s", trial, err)
+		} else if trial.status != 0 && (err == nil || err.(*authError).status != trial.status) {
+			t.Errorf("%+v: expected status %d, got %v", trial, trial.status, err)
+		} else if limits.maxDuration != trial.session {
+			t.Errorf("%+v: expected session %s, got %s", trial, trial.session, limits.maxDuration)
+		}
+	}
+}
+
+func TestServerRequiresAuth(t *testing.T) {
+	fn := writeAuthKeys(t, `{"tokens":[{"token":"abc"}]}`)
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:         ":0",
+		AuthKeyFile:  fn,
+		FrameBytes:   16,
+		Path:         "/dev/zero",
+		Reopen:       true,
+		RequireAuth:  true,
+		SourceBuffer: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for _, trial := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"xyz", http.StatusForbidden},
+		{"abc", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/", srv.Addr), nil)
+		if trial.token != "" {
+			req.Header.Set("Authorization", "Bearer "+trial.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != trial.status {
+			t.Errorf("token %q: expected %d, got %s", trial.token, trial.status, resp.Status)
+		}
+		if trial.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: no WWW-Authenticate header", trial.token)
+		}
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/dev/zero", &Config{FrameBytes: 16, SourceBuffer: 4, SourceBandwidth: 16000, CloseIdle: true})
+	defer rdr.Close()
+	rdr.expires = time.Now().Add(50 * time.Millisecond)
+	buf := make([]byte, 16)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n, err := rdr.Read(buf)
+		if err == ErrSessionExpired {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		} else if n != 16 {
+			t.Fatalf("read %d bytes, expected whole frame", n)
+		}
+	}
+	t.Error("session did not expire")
+}
+
+func TestSignedURLExpires(t *testing.T) {
+	keys := &AuthKeys{Secret: "s3cret"}
+	now := time.Now()
+	// Expires in 1-2 seconds.
+	exp := strconv.FormatInt(now.Unix()+2, 10)
+	req := &http.Request{
+		URL:    &url.URL{Path: "/dev/zero", RawQuery: "exp=" + exp + "&dur=1h&sig=" + keys.SignURL("/dev/zero", exp, "1h")},
+		Header: http.Header{},
+	}
+	limits, err := keys.authorize(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/dev/zero", &Config{FrameBytes: 16, SourceBuffer: 4, SourceBandwidth: 16000, CloseIdle: true})
+	defer rdr.Close()
+	limits.apply(rdr, now)
+	buf := make([]byte, 16)
+	frames := 0
+	for deadline := now.Add(5 * time.Second); time.Now().Before(deadline); frames++ {
+		if _, err := rdr.Read(buf); err == ErrSessionExpired {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frames == 0 || time.Now().Unix() < now.Unix()+2 || time.Since(now) > 3*time.Second {
+		t.Errorf("session ended after %d frames, %s", frames, time.Since(now))
+	}
+}
+
+func TestSessionExpiresWhileWaiting(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	// The source never supplies a frame.
+	rdr := sm.NewReader("/stream", &Config{
+		Args:         []string{"sh", "-c", "exec sleep 10"},
+		ExecFlag:     true,
+		CloseIdle:    true,
+		FrameBytes:   16,
+		SourceBuffer: 4,
+	})
+	defer rdr.Close()
+	rdr.expires = time.Now().Add(100 * time.Millisecond)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := rdr.Read(make([]byte, 16))
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrSessionExpired {
+			t.Errorf("expected ErrSessionExpired, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("session did not expire while waiting for a frame")
+	}
+}
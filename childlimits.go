@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// childLimits are resource limits and scheduling priorities for -exec
+// child processes. They can't be set through exec.Cmd, so they are
+// applied by a copy of streamserve that runs before the real command
+// (see wrapChild).
+type childLimits struct {
+	cpu         uint64 // RLIMIT_CPU, seconds
+	as          uint64 // RLIMIT_AS, bytes
+	nofile      uint64 // RLIMIT_NOFILE
+	nice        int
+	ioniceClass int // 1=realtime, 2=best-effort, 3=idle; 0=unchanged
+	ioniceLevel int
+}
+
+func (c *Config) childLimits() (cl childLimits, err error) {
+	cl.cpu = uint64((c.ExecRlimitCPU + 999999999) / 1000000000)
+	cl.as = c.ExecRlimitAS
+	cl.nofile = c.ExecRlimitNofile
+	cl.nice = c.ExecNice
+	if c.ExecIonice != "" {
+		cl.ioniceClass, cl.ioniceLevel, err = parseIonice(c.ExecIonice)
+	}
+	return
+}
+
+var ioniceClasses = []string{"", "realtime", "best-effort", "idle"}
+
+// parseIonice parses an -exec-ionice value: "idle", or
+// "best-effort" or "realtime" optionally followed by ":" and a level
+// from 0 (highest priority) to 7.
+func parseIonice(s string) (class, level int, err error) {
+	name, lvl, hasLevel := strings.Cut(s, ":")
+	for i, n := range ioniceClasses {
+		if n != "" && n == name {
+			class = i
+		}
+	}
+	if class == 0 {
+		return 0, 0, fmt.Errorf("unknown I/O scheduling class %q; try one of %q", name, ioniceClasses[1:])
+	}
+	if class == 3 && hasLevel {
+		return 0, 0, errors.New("the idle I/O scheduling class has no levels")
+	}
+	if hasLevel {
+		level, err = strconv.Atoi(lvl)
+		if err != nil || level < 0 || level > 7 {
+			return 0, 0, fmt.Errorf("I/O priority level %q must be 0-7", lvl)
+		}
+	} else if class != 3 {
+		level = 4
+	}
+	return
+}
+
+// String encodes cl for the wrapper process, as comma-separated
+// name=value pairs. Unset limits are omitted.
+func (cl childLimits) String() string {
+	var parts []string
+	for _, p := range []struct {
+		name string
+		val  uint64
+	}{{"cpu", cl.cpu}, {"as", cl.as}, {"nofile", cl.nofile}} {
+		if p.val > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", p.name, p.val))
+		}
+	}
+	if cl.nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice=%d", cl.nice))
+	}
+	if cl.ioniceClass != 0 {
+		parts = append(parts, fmt.Sprintf("ionice=%d:%d", cl.ioniceClass, cl.ioniceLevel))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseChildLimits decodes a childLimits encoded by String.
+func parseChildLimits(spec string) (cl childLimits, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		if part == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(part, "=")
+		switch name {
+		case "cpu":
+			cl.cpu, err = strconv.ParseUint(val, 10, 64)
+		case "as":
+			cl.as, err = strconv.ParseUint(val, 10, 64)
+		case "nofile":
+			cl.nofile, err = strconv.ParseUint(val, 10, 64)
+		case "nice":
+			cl.nice, err = strconv.Atoi(val)
+		case "ionice":
+			_, err = fmt.Sscanf(val, "%d:%d", &cl.ioniceClass, &cl.ioniceLevel)
+		default:
+			err = fmt.Errorf("unknown limit %q", name)
+		}
+		if err != nil {
+			return cl, fmt.Errorf("child limits %q: %s", spec, err)
+		}
+	}
+	return
+}
+
+// formatCredential encodes cred for the wrapper process, as
+// "uid:gid:group,group,...".
+func formatCredential(cred *syscall.Credential) string {
+	groups := make([]string, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = strconv.FormatUint(uint64(g), 10)
+	}
+	return fmt.Sprintf("%d:%d:%s", cred.Uid, cred.Gid, strings.Join(groups, ","))
+}
+
+// parseCredential decodes a credential encoded by formatCredential.
+func parseCredential(spec string) (*syscall.Credential, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("credential %q: expected uid:gid:groups", spec)
+	}
+	ids := []string{fields[0], fields[1]}
+	if fields[2] != "" {
+		ids = append(ids, strings.Split(fields[2], ",")...)
+	}
+	nums := make([]uint32, len(ids))
+	for i, id := range ids {
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("credential %q: %s", spec, err)
+		}
+		nums[i] = uint32(n)
+	}
+	return &syscall.Credential{Uid: nums[0], Gid: nums[1], Groups: nums[2:]}, nil
+}
+
+// childCredential returns the user and group to run child processes
+// as (see -exec-user and -exec-group), or nil to run them as
+// streamserve's own user.
+func (c *Config) childCredential() (*syscall.Credential, error) {
+	if c.ExecUser == "" && c.ExecGroup == "" {
+		return nil, nil
+	}
+	cred := &syscall.Credential{
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Groups: []uint32{},
+	}
+	if c.ExecUser != "" {
+		u, err := user.Lookup(c.ExecUser)
+		if err != nil {
+			if u, err = user.LookupId(c.ExecUser); err != nil {
+				return nil, fmt.Errorf("-exec-user: %s", err)
+			}
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		// Supplementary groups, if we can find them.
+		gids, _ := u.GroupIds()
+		for _, g := range gids {
+			if gid, err := strconv.ParseUint(g, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+	if c.ExecGroup != "" {
+		g, err := user.LookupGroup(c.ExecGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(c.ExecGroup); err != nil {
+				return nil, fmt.Errorf("-exec-group: %s", err)
+			}
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		cred.Gid = uint32(gid)
+	}
+	return cred, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// childLimitsEnv is set in the environment of a wrapper process (see
+// wrapChild) to the limits it should apply.
+const childLimitsEnv = "STREAMSERVE_CHILD_LIMITS"
+
+// childCredentialEnv is set in the environment of a wrapper process
+// to the user and groups it should switch to after applying limits.
+const childCredentialEnv = "STREAMSERVE_CHILD_CREDENTIAL"
+
+const ioprioWhoProcess = 1
+
+func init() {
+	spec, ok := os.LookupEnv(childLimitsEnv)
+	if !ok {
+		return
+	}
+	// Priorities are per thread: set them on the thread that
+	// calls exec.
+	runtime.LockOSThread()
+	cred := os.Getenv(childCredentialEnv)
+	os.Unsetenv(childLimitsEnv)
+	os.Unsetenv(childCredentialEnv)
+	err := execLimited(spec, cred, os.Args[1:])
+	fmt.Fprintf(os.Stderr, "streamserve: %s\n", err)
+	os.Exit(126)
+}
+
+// execLimited applies the limits encoded in spec, switches to the
+// user and groups encoded in credSpec (if not empty), then executes
+// args[0] with arguments args[1:]. It only returns on error.
+//
+// The user is switched last, because raising a limit or priority
+// (e.g., a negative -exec-nice) needs privileges the new user might
+// not have.
+func execLimited(spec, credSpec string, args []string) error {
+	cl, err := parseChildLimits(spec)
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Credential
+	if credSpec != "" {
+		if cred, err = parseCredential(credSpec); err != nil {
+			return err
+		}
+	}
+	if len(args) < 2 {
+		return errors.New("no command given")
+	}
+	for _, rl := range []struct {
+		resource int
+		val      uint64
+	}{
+		{syscall.RLIMIT_CPU, cl.cpu},
+		{syscall.RLIMIT_AS, cl.as},
+		{syscall.RLIMIT_NOFILE, cl.nofile},
+	} {
+		if rl.val == 0 {
+			continue
+		}
+		var lim syscall.Rlimit
+		if err := syscall.Getrlimit(rl.resource, &lim); err != nil {
+			return err
+		}
+		lim.Cur = rl.val
+		if lim.Max > rl.val {
+			lim.Max = rl.val
+		} else {
+			lim.Cur = lim.Max
+		}
+		if err := syscall.Setrlimit(rl.resource, &lim); err != nil {
+			return fmt.Errorf("setrlimit: %s", err)
+		}
+	}
+	if cl.nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, cl.nice); err != nil {
+			return fmt.Errorf("setpriority: %s", err)
+		}
+	}
+	if cl.ioniceClass != 0 {
+		prio := uintptr(cl.ioniceClass<<13 | cl.ioniceLevel)
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); errno != 0 {
+			return fmt.Errorf("ioprio_set: %s", errno)
+		}
+	}
+	if cred != nil {
+		if err := syscall.Setgroups(intIDs(cred.Groups)); err != nil {
+			return fmt.Errorf("setgroups: %s", err)
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			return fmt.Errorf("setgid: %s", err)
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			return fmt.Errorf("setuid: %s", err)
+		}
+	}
+	return syscall.Exec(args[0], args[1:], os.Environ())
+}
+
+func intIDs(ids []uint32) []int {
+	ints := make([]int, len(ids))
+	for i, id := range ids {
+		ints[i] = int(id)
+	}
+	return ints
+}
+
+// wrapChild makes cmd start a copy of streamserve, which applies cl
+// and then executes the real command (in the same process, so
+// signals and -exec-pgroup still work). If cmd has a Credential, the
+// copy switches to it after applying cl, instead of starting as that
+// user.
+func wrapChild(cmd *exec.Cmd, cl childLimits) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, childLimitsEnv+"="+cl.String())
+	if attr := cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		cmd.Env = append(cmd.Env, childCredentialEnv+"="+formatCredential(attr.Credential))
+		attr.Credential = nil
+	}
+	cmd.Args = append([]string{"streamserve", cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+}
+
+func checkChildLimits(cl childLimits) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func wrapChild(cmd *exec.Cmd, cl childLimits) {}
+
+func checkChildLimits(cl childLimits) error {
+	if cl != (childLimits{}) {
+		return errors.New("-exec-rlimit-*, -exec-nice, and -exec-ionice are only supported on Linux")
+	}
+	return nil
+}
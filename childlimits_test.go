@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseIonice(t *testing.T) {
+	for _, trial := range []struct {
+		spec         string
+		class, level int
+		ok           bool
+	}{
+		{"idle", 3, 0, true},
+		{"best-effort", 2, 4, true},
+		{"best-effort:7", 2, 7, true},
+		{"realtime:0", 1, 0, true},
+		{"idle:1", 0, 0, false},
+		{"best-effort:8", 0, 0, false},
+		{"lazy", 0, 0, false},
+	} {
+		class, level, err := parseIonice(trial.spec)
+		if (err == nil) != trial.ok || class != trial.class || level != trial.level {
+			t.Errorf("%q: got %d, %d, %v", trial.spec, class, level, err)
+		}
+	}
+}
+
+func TestChildLimitsString(t *testing.T) {
+	for _, cl := range []childLimits{
+		{},
+		{cpu: 10, nofile: 64},
+		{as: 1 << 30, nice: -5, ioniceClass: 2, ioniceLevel: 7},
+	} {
+		got, err := parseChildLimits(cl.String())
+		if err != nil || got != cl {
+			t.Errorf("%+v: %q parsed as %+v, %v", cl, cl.String(), got, err)
+		}
+	}
+	if _, err := parseChildLimits("cpu=1,bogus=2"); err == nil {
+		t.Error("expected error for unknown limit")
+	}
+}
+
+// readExecOutput returns the output of a child process started by a
+// source with the given config.
+func readExecOutput(t *testing.T, c *Config) string {
+	c.ExecFlag = true
+	c.CloseIdle = true
+	c.FrameBytes = 1
+	c.SourceBuffer = 100
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/stream", c)
+	defer rdr.Close()
+	done := make(chan []byte)
+	go func() {
+		got, _ := ioutil.ReadAll(rdr)
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		return string(got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		return ""
+	}
+}
+
+func TestExecLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("child limits are only supported on Linux")
+	}
+	got := readExecOutput(t, &Config{
+		Args:             []string{"sh", "-c", `printf "%s %s %s" "$(ulimit -n)" "$(ulimit -t)" "$(cut -d" " -f19 /proc/self/stat)"`},
+		ExecRlimitCPU:    1500 * time.Millisecond,
+		ExecRlimitNofile: 64,
+		ExecNice:         5,
+	})
+	if got != "64 2 5" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestExecUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("not running as root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	got := readExecOutput(t, &Config{
+		Args:     []string{"sh", "-c", "printf %s $(id -u)"},
+		ExecUser: "nobody",
+	})
+	if got != nobody.Uid {
+		t.Errorf("expected uid %s, got %q", nobody.Uid, got)
+	}
+}
+
+func TestCredentialString(t *testing.T) {
+	for _, cred := range []*syscall.Credential{
+		{Uid: 65534, Gid: 65534, Groups: []uint32{}},
+		{Uid: 1000, Gid: 29, Groups: []uint32{29, 44}},
+	} {
+		got, err := parseCredential(formatCredential(cred))
+		if err != nil || !reflect.DeepEqual(got, cred) {
+			t.Errorf("%+v: %q parsed as %+v, %v", cred, formatCredential(cred), got, err)
+		}
+	}
+	if _, err := parseCredential("1:2"); err == nil {
+		t.Error("expected error for missing groups")
+	}
+}
+
+// A negative -exec-nice needs privileges that -exec-user drops, so
+// it must be applied first.
+func TestExecUserNice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("child limits are only supported on Linux")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("not running as root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	got := readExecOutput(t, &Config{
+		Args:     []string{"sh", "-c", `printf "%s %s" $(id -u) "$(cut -d" " -f19 /proc/self/stat)"`},
+		ExecUser: "nobody",
+		ExecNice: -5,
+	})
+	if expect := nobody.Uid + " -5"; got != expect {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
+
+func TestCheckExecUser(t *testing.T) {
+	c := &Config{ExecUser: "no-such-user-here"}
+	if _, err := c.childCredential(); err == nil {
+		t.Error("expected error for unknown user")
+	}
+}
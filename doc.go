@@ -104,6 +104,28 @@ maximum: it must be big enough to hold the biggest frame.
 
   -filter mp3 -frame-bytes 2048
 
+The mp3 filter also skips ID3v2, ID3v1, and APE tags, wherever they
+appear in the input (for example, between tracks in a concatenated
+stream), using the tag's size field rather than scanning through it
+for frame headers. With -tag-metadata, the title and artist in each
+tag are logged, and shown in the admin source list.
+
+  -filter mp3 -frame-bytes 2048 -tag-metadata
+
+By default, the mp3 filter accepts anything that looks like a valid
+frame header, so after a glitch in the input, random data can get
+through as a frame. With -mp3-sync N, after a glitch (and at the
+start of the stream) a frame is accepted only if the next N frame
+headers agree on MPEG version, layer, and sample rate. With -mp3-crc,
+layer III frames with a CRC-16 that doesn't match are rejected.
+Rejected frames are counted in the streamserve_source_frames_rejected_total
+metric.
+
+  -filter mp3 -frame-bytes 2048 -mp3-sync 3 -mp3-crc
+
+-frame-bytes should be big enough to hold N+1 frames; otherwise, as
+many headers as fit are checked.
+
 Buffers
 
 Data from the input FIFO is read into a fixed-size ring buffer, with a
@@ -120,6 +142,51 @@ actual frame sizes: If using -filter=mp3, the above example will skip
 frames when a client lags behind by 1024 mp3 frames (not 1048576
 bytes).
 
+Each frame is sent to a client as soon as it arrives, as long as the
+client is keeping up. When a client is lagging behind, several frames
+are sent at once, which reduces CPU usage, especially with small
+frames. Send buffered frames to lagging clients when 64 KiB are
+waiting, or when the oldest has been waiting 100 ms:
+
+  -flush-bytes 65536 -flush-interval 100ms
+
+Send every frame right away, even to lagging clients:
+
+  -flush-bytes 0
+
+By default, each client is served by its own goroutine. With very
+large numbers of clients, use a few writer goroutines per source
+instead. Each writer sends frames to many clients using non-blocking
+writes, so a client that isn't reading doesn't hold up the others.
+This uses less memory per client.
+
+  -delivery pool -pool-writers 4
+
+Slow clients
+
+By default, a client that falls too far behind skips frames to catch
+up. Some clients, like recorders and transcoders, would rather be
+disconnected with a clear error.
+
+Disconnect a client when it has skipped more than 10 frames:
+
+  -slow-client-policy disconnect-after-skips -slow-client-max-skips 10
+
+Disconnect a client when it is more than 5 seconds behind, or when it
+falls behind by more than the source buffer:
+
+  -slow-client-policy disconnect-on-lag -slow-client-max-lag 5s
+
+Keep up to 256 frames for each client after they leave the source
+buffer, and disconnect the client if that isn't enough. Queued frames
+use extra memory for each lagging client.
+
+  -slow-client-policy queue -slow-client-queue 256
+
+When a policy disconnects a client, the policy is logged, and (when
+the response is chunked) sent in the Streamserve-Slow-Client-Policy
+HTTP trailer.
+
 Sources
 
 Read from a fifo.
@@ -138,6 +205,179 @@ Run a shell command in the child process.
 
   -exec sh -c 'cat /dev/urandom | base64'
 
+Give the child process extra environment variables and a working
+directory, log its stderr (prefixed with the source label, and
+limited to -exec-stderr-rate lines per second), and run it in its own
+process group, so stopping the source stops the whole pipeline.
+The child also gets STREAMSERVE_SOURCE, the source label, and (for a
+mount in a -config file) STREAMSERVE_PATH, the mount's URI path.
+These settings also apply to "exec:" fallbacks.
+
+  -exec-env RATE=64 -exec-dir /srv/radio -exec-stderr -exec-pgroup \
+  -exec sh -c 'curl -sS localhost:44100 | lame -r -b $RATE - -'
+
+In a config file, "exec-env" is an array of "NAME=VALUE" strings.
+
+Run the child process as an unprivileged user, with resource limits
+and low CPU and I/O priority, so an untrusted transcoder can't take
+the whole server down. Changing the user requires streamserve to run
+as root. The limits and priorities are Linux only; they are applied
+by a copy of streamserve that then switches to -exec-user (so a
+negative -exec-nice or realtime -exec-ionice still works) and
+executes the command.
+
+  -exec-user nobody -exec-group audio \
+  -exec-rlimit-cpu 1h -exec-rlimit-as 536870912 -exec-rlimit-nofile 64 \
+  -exec-nice 10 -exec-ionice idle
+
+Loop a media file, or the files in a playlist, in real time. A
+playlist is an M3U file or a plain text file (.m3u, .m3u8, or .txt)
+with one file name per line; lines starting with "#" are ignored.
+ID3 and APE tags are skipped, so the files make one continuous
+stream. When a file ends, the playlist is reread if it has changed.
+
+  -playlist /srv/channel1.m3u -frame-filter mp3
+
+Play the files in random order, reshuffling each time through the
+list:
+
+  -playlist /srv/channel1.m3u -frame-filter mp3 -shuffle
+
+Fallbacks
+
+Keep clients connected when the source input fails, by switching to
+a fallback input: another fifo or file, a shell command (prefixed
+with "exec:"), a playlist (prefixed with "playlist:"), or another
+http stream to relay. Fallbacks are tried
+in order. While a fallback is in use, the source input is retried at
+the given interval, and when it works again, the source switches
+back. Clients don't notice the switch, except for the change in
+content.
+
+  -fallback /var/run/backup.fifo -fallback playlist:/srv/offline.m3u -fallback-retry 5s
+
+With -header-bytes, an input whose header doesn't match the one
+already sent to clients is not used.
+
+In a config file, give fallbacks as an array:
+
+  "fallback": ["/var/run/backup.fifo", "http://relay.example/radio.mp3"]
+
+The admin source list shows which input is in use, and the
+streamserve_source_fallback metric is 1 while a fallback is in use.
+
+Multiple streams
+
+Serve several streams, each with its own source and settings, by
+listing them in a JSON config file. Each mount is served at its
+own URI path. Mount settings use the same names as command line
+flags; settings that are not given for a mount are taken from the
+command line, except the input: each mount must give "path", "exec",
+or "playlist". Instead of -exec, give the command as an array.
+
+  -config /etc/streamserve.json
+
+Example config file:
+
+  {"mounts": {
+    "/pcm": {
+      "exec": ["arecord", "-f", "cd", "--file-type", "raw"],
+      "frame-bytes": 44100,
+      "source-buffer": 40
+    },
+    "/radio.mp3": {
+      "path": "/var/run/radio.fifo",
+      "frame-filter": "mp3",
+      "frame-bytes": 2048,
+      "source-buffer": 1000,
+      "content-type": "audio/mpeg",
+      "allow": ["10.0.0.0/8", "127.0.0.1"],
+      "deny": ["10.9.0.0/16"]
+    }
+  }}
+
+Clients are refused (403) unless their address matches an "allow"
+network (if any are given), and doesn't match a "deny" network.
+Requests for other paths get 404.
+
+Send SIGHUP to reread the config file without restarting. New mounts
+are added. Removed mounts are closed: their clients are disconnected
+after receiving the frames remaining in the buffer. Changes to
+content-type, client-max-bytes, source-bandwidth, close-idle, reopen,
+child-kill-delay, the slow client settings, require-auth, allow, and
+deny take effect right away. Other changes need a new ring buffer, so
+they take effect the next time the source is reopened; connected
+clients continue with the new source. The result of each reload is
+logged.
+
+  kill -HUP $(pidof streamserve)
+
+Authentication
+
+Require each client to give a bearer token or a signed URL. Tokens
+and the secret for signed URLs are read from a JSON file, which is
+reread on SIGHUP. In a config file, "require-auth" can be set per
+mount.
+
+  -require-auth -auth-key-file /etc/streamserve/auth.json
+
+Example key file:
+
+  {"secret": "long-random-string",
+   "tokens": [
+     {"token": "relay-token"},
+     {"token": "guest-token", "paths": ["/radio.mp3"], "max-session": "1h"}
+   ]}
+
+A token with "paths" can only be used for those URI paths. A token
+with "max-session" or "max-stream-time" overrides
+-client-max-duration or -client-max-stream-time.
+
+  curl -H "Authorization: Bearer guest-token" http://host/radio.mp3
+
+A signed URL has an expiry time (unix timestamp) after which new
+connections are refused and connected clients are disconnected (at
+a frame boundary), an optional maximum session duration that
+overrides -client-max-duration, and an HMAC-SHA256 signature of the
+path, exp, and dur, separated by newlines, using the secret as key:
+
+  exp=$(($(date +%s) + 3600)) dur=30m
+  sig=$(printf '%s\n%s\n%s' /radio.mp3 $exp $dur | openssl dgst -sha256 -hmac "$SECRET" | sed 's/.* //')
+  curl "http://host/radio.mp3?exp=$exp&dur=$dur&sig=$sig"
+
+Clients with no credentials get 401; clients with invalid or expired
+credentials get 403.
+
+Ask an external service whether to start each client, by posting a
+JSON description of the request to a URL. Use a unix socket instead
+of the host in the URL, if given. In a config file, "auth-webhook"
+can be set per mount.
+
+  -auth-webhook http://localhost/streamserve -auth-webhook-socket /run/billing.sock -auth-webhook-timeout 5s
+
+The request looks like:
+
+  {"event": "connect", "remote-addr": "10.1.2.3:45678", "ip": "10.1.2.3",
+   "path": "/radio.mp3", "query": "user=abc", "headers": {"User-Agent": ["..."]}}
+
+The webhook replies with status 200 and a JSON object. "max-bytes",
+"max-session", and "max-stream-time" override -client-max-bytes,
+-client-max-duration, and -client-max-stream-time for this client,
+but can't extend a limit set by the client's token or signed URL;
+"session" is returned in the disconnect notification.
+
+  {"allow": true, "session": "abc-123", "max-bytes": 100000000, "max-session": "2h"}
+
+If "allow" is false, the client gets 403 with the given "reason". If
+the webhook fails or times out, the client gets 503.
+
+When an allowed client disconnects, its statistics are posted to the
+same URL:
+
+  {"event": "disconnect", "session": "abc-123", "client": 17,
+   "remote-addr": "10.1.2.3:45678", "path": "/radio.mp3", "bytes": 5760000,
+   "frames-read": 13824, "frames-skipped": 0, "seconds": 360.2}
+
 HTTP headers
 
 Specify MIME type.
@@ -167,6 +407,82 @@ clients and exit.
 
   -reopen=false
 
+Wait before reopening, so an input that fails right away (e.g., a
+child process that exits with an error) doesn't restart in a tight
+loop. The delay doubles, with random jitter, after each consecutive
+failure, up to a maximum. An input counts as failed if it can't be
+opened, or closes before supplying a frame.
+
+  -restart-delay 100ms -restart-delay-max 30s
+
+After several consecutive failures within a time window, mark the
+source as failed: new clients get 503 Service Unavailable (with a
+Retry-After header) until the input supplies a frame again. Failed
+sources are shown in the admin source list and the
+streamserve_source_failed metric. This is disabled by default, and
+the systemd watchdog (see below) relies on it to detect broken
+sources.
+
+  -restart-fail-count 5 -restart-fail-window 1m
+
+While the input is reopening, keep clients connected by sending
+filler frames at the stream's real-time rate, until the input
+supplies a frame again. Send silence (zeroes for raw PCM; silent
+frames with the same bitrate and sample rate as the last frame for
+-frame-filter mp3):
+
+  -filler silence
+
+Send frames from a file, over and over:
+
+  -filler /srv/please-stand-by.mp3
+
+Filler is paced by the MP3 frame durations with -frame-filter mp3,
+or by -raw-byte-rate if given, or else by -source-bandwidth.
+
+On SIGTERM or SIGINT, stop accepting new connections, let each client
+finish receiving its current frame, then close all sources. Clients
+still connected after the shutdown timeout are disconnected.
+
+  -shutdown-timeout 10s
+
+When closing a child process, send SIGTERM first, and SIGKILL only
+if it is still running after the given delay.
+
+  -child-kill-delay 2s
+
+Systemd
+
+Streamserve supports systemd socket activation: if systemd passes a
+listening socket (LISTEN_FDS), streamserve uses it instead of
+-address. Systemd can then bind port 80 without giving streamserve
+root privileges, and keep the socket open while streamserve
+restarts.
+
+  # /etc/systemd/system/streamserve.socket
+  [Socket]
+  ListenStream=80
+
+  [Install]
+  WantedBy=sockets.target
+
+With Type=notify, streamserve tells systemd when it is ready
+(READY=1) and when it is shutting down (STOPPING=1). With
+WatchdogSec, it sends keep-alive pings (WATCHDOG=1) at half that
+interval, as long as its sources are healthy: it stops sending them,
+so systemd restarts it, if every source has failed or the source map
+stops responding. Sources are only marked as failed if
+-restart-fail-count is set (per mount, or on the command line), so
+without it the watchdog only detects a stuck server, not broken
+inputs.
+
+  # /etc/systemd/system/streamserve.service
+  [Service]
+  Type=notify
+  WatchdogSec=30
+  ExecStart=/usr/bin/streamserve -config /etc/streamserve.json
+  ExecReload=/bin/kill -HUP $MAINPID
+
 Limits
 
 Limit CPU usage. The default is to use as many threads as you have CPU
@@ -174,10 +490,29 @@ cores.
 
   -cpu-max 1
 
+Limit the number of clients connected to the server, to each stream,
+and from each IP address. Clients over the server or stream limit get
+503 Service Unavailable; clients over the per-IP limit get 429 Too
+Many Requests. Both include a Retry-After header.
+
+  -max-clients 5000 -max-clients-per-stream 1000 -max-clients-per-ip 10 -limit-retry-after 30s
+
+Exempt some networks (e.g., internal relays) from client limits:
+
+  -limit-exempt 10.0.0.0/8,192.168.1.5
+
 Disconnect clients after a specified number of bytes.
 
   -client-max-bytes 1000000000
 
+Disconnect clients after a specified time. With -client-max-stream-time,
+time is measured by the playing time of the frames sent, which needs
+-frame-filter mp3 or -raw-byte-rate. Either way, the response ends at
+a frame boundary.
+
+  -client-max-duration 2h
+  -client-max-stream-time 1h
+
 Limit how fast the input is read. (This is meant for testing. You
 could also use it to serve static content from a regular file as if it
 were a live stream, although a regular static file server would
@@ -186,6 +521,15 @@ default is to read data as fast as the input FIFO supplies it.
 
   -source-bandwidth 16000
 
+Read the input no faster than real time, according to the media
+duration of each frame, rather than a fixed number of bytes per
+second. This works for variable bitrate MP3 streams, and makes it
+practical to serve a file as a live stream. With the raw filter,
+give the media byte rate (sample rate * channels * bytes per sample):
+
+  -realtime -frame-filter mp3 -reopen -path /srv/loop.mp3
+  -realtime -raw-byte-rate 176400
+
 Close the input (and kill the child process, if applicable) if the
 given interval elapses without reading any data. Can be specified in
 units h, m, s, ms, us, ns. After closing, reopen or quit depending on
@@ -193,5 +537,47 @@ units h, m, s, ms, us, ns. After closing, reopen or quit depending on
 
   -max-quiet-interval 1m
 
+Monitoring
+
+Serve source and client statistics in the Prometheus text exposition
+format, at /metrics by default. Metrics are labelled by source.
+Counters and histograms carry on from where they left off when a
+source closes and reopens (e.g., with -close-idle). Frames skipped by
+each client, and the duration of each client session, are reported
+as histograms when the client disconnects. Serve them at a different
+path, or use "" to turn them off.
+
+  -metrics-path /stats/metrics
+
+Log statistics for each source, and for each connected client
+(including frames skipped since the previous log entry and how many
+frames the client is lagging behind the source), at regular intervals.
+
+  -stat-log-interval 1m -client-stats-log-interval 1m
+
+Administration
+
+Serve an admin API under the given path prefix. Every request must
+include the token from the given file as a bearer token. Responses
+are JSON.
+
+  -admin-path /admin -admin-token-file /etc/streamserve/admin-token
+
+Show all open sources, their ring buffer positions, and their clients:
+
+  curl -H "Authorization: Bearer $TOKEN" http://host/admin/sources
+
+Disconnect a client (at the next frame boundary), using the client
+ID shown in the source list:
+
+  curl -X POST -H "Authorization: Bearer $TOKEN" http://host/admin/kick?client=123
+
+Close and reopen a source, as -max-quiet-interval would. This reopens
+the source even if -reopen=false. For -exec sources, "restart" does
+the same thing, but fails if the source has no child process:
+
+  curl -X POST -H "Authorization: Bearer $TOKEN" http://host/admin/reopen?source=/dev/stdin
+  curl -X POST -H "Authorization: Bearer $TOKEN" http://host/admin/restart?source=/dev/stdin
+
 */
 package main
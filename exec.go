@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execOptions are the settings for starting -exec and "exec:"
+// -fallback child processes.
+type execOptions struct {
+	label      string   // source label, for log messages
+	env        []string // added to our own environment
+	dir        string
+	logStderr  bool
+	stderrRate int // max stderr lines logged per second
+	pgroup     bool
+	cred       *syscall.Credential // see -exec-user and -exec-group
+	limits     childLimits
+	err        error // from looking up cred or limits
+}
+
+func (c *Config) execOptions(label string) *execOptions {
+	env := []string{"STREAMSERVE_SOURCE=" + label}
+	if c.Name != "" {
+		// Without a config file, every URI path serves
+		// the same stream, so there's no path to give.
+		env = append(env, "STREAMSERVE_PATH="+c.Name)
+	}
+	eo := &execOptions{
+		label:      label,
+		env:        append(env, c.ExecEnv...),
+		dir:        c.ExecDir,
+		logStderr:  c.ExecStderr,
+		stderrRate: c.ExecStderrRate,
+		pgroup:     c.ExecPgroup,
+	}
+	eo.cred, eo.err = c.childCredential()
+	if eo.err == nil {
+		eo.limits, eo.err = c.childLimits()
+	}
+	return eo
+}
+
+// command returns a Cmd that runs args with the given options.
+func (eo *execOptions) command(args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	if eo == nil {
+		return cmd
+	}
+	cmd.Env = append(os.Environ(), eo.env...)
+	cmd.Dir = eo.dir
+	if eo.logStderr {
+		cmd.Stderr = &stderrLogger{label: eo.label, rate: eo.stderrRate}
+		// Don't let a grandchild that holds stderr open keep
+		// Wait from returning.
+		cmd.WaitDelay = time.Second
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    eo.pgroup,
+		Credential: eo.cred,
+	}
+	if eo.limits != (childLimits{}) {
+		wrapChild(cmd, eo.limits)
+	}
+	if eo.err != nil {
+		// Don't start the child without the requested
+		// credentials or limits.
+		cmd.Err = eo.err
+	}
+	return cmd
+}
+
+// signalCmd sends sig to cmd's process, or to its whole process group
+// if it was started with -exec-pgroup.
+func signalCmd(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, sig)
+	}
+	return cmd.Process.Signal(sig)
+}
+
+// A stderrLogger writes a child process's stderr to our log, one
+// line at a time, prefixed with the source label. It logs at most
+// rate lines per second (on average, with bursts up to rate lines),
+// and reports how many lines it drops.
+type stderrLogger struct {
+	label   string
+	rate    int
+	partial []byte    // incomplete last line
+	tokens  float64   // lines we can log now
+	refill  time.Time // when tokens was last updated
+	dropped int
+	mtx     sync.Mutex
+}
+
+// maxStderrLine is the longest line logged by stderrLogger. Longer
+// lines are split.
+const maxStderrLine = 1024
+
+func (sl *stderrLogger) Write(p []byte) (int, error) {
+	sl.mtx.Lock()
+	defer sl.mtx.Unlock()
+	buf := append(sl.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 && len(buf) < maxStderrLine {
+			break
+		}
+		if i < 0 || i > maxStderrLine {
+			i = maxStderrLine
+			sl.logLine(buf[:i])
+			buf = buf[i:]
+		} else {
+			sl.logLine(buf[:i])
+			buf = buf[i+1:]
+		}
+	}
+	sl.partial = append(sl.partial[:0], buf...)
+	return len(p), nil
+}
+
+func (sl *stderrLogger) logLine(line []byte) {
+	now := time.Now()
+	if sl.rate > 0 {
+		if !sl.refill.IsZero() {
+			sl.tokens += now.Sub(sl.refill).Seconds() * float64(sl.rate)
+		} else {
+			sl.tokens = float64(sl.rate)
+		}
+		if sl.tokens > float64(sl.rate) {
+			sl.tokens = float64(sl.rate)
+		}
+		sl.refill = now
+		if sl.tokens < 1 {
+			sl.dropped++
+			return
+		}
+		sl.tokens--
+	}
+	if sl.dropped > 0 {
+		log.Printf("source %s stderr: (%d lines dropped)", sl.label, sl.dropped)
+		sl.dropped = 0
+	}
+	log.Printf("source %s stderr: %s", sl.label, bytes.TrimRight(line, "\r"))
+}
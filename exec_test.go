@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStderrLogger(t *testing.T) {
+	logbuf := &bytes.Buffer{}
+	log.SetOutput(logbuf)
+	defer log.SetOutput(os.Stderr)
+	sl := &stderrLogger{label: "test", rate: 2}
+	sl.Write([]byte("one\ntw"))
+	sl.Write([]byte("o\nthree\nfour\n"))
+	if got := logbuf.String(); !strings.Contains(got, "source test stderr: one\n") || !strings.Contains(got, "stderr: two\n") || strings.Contains(got, "three") {
+		t.Errorf("log: %q", got)
+	}
+	logbuf.Reset()
+	sl.refill = sl.refill.Add(-time.Second)
+	sl.Write([]byte(strings.Repeat("x", maxStderrLine+10) + "\n"))
+	if got := logbuf.String(); !strings.Contains(got, "(2 lines dropped)") || strings.Count(got, "x") != maxStderrLine+10 {
+		t.Errorf("log: %q", got)
+	}
+}
+
+func TestExecOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamserve-exec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logbuf := &bytes.Buffer{}
+	log.SetOutput(logbuf)
+	defer log.SetOutput(os.Stderr)
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/stream", &Config{
+		Name:         "/stream",
+		Args:         []string{"sh", "-c", `echo oops >&2; printf "%s %s %s" "$STREAMSERVE_PATH" "$FOO" "$(pwd)"`},
+		ExecFlag:     true,
+		ExecEnv:      []string{"FOO=bar"},
+		ExecDir:      dir,
+		ExecStderr:   true,
+		CloseIdle:    true,
+		FrameBytes:   1,
+		SourceBuffer: 100,
+	})
+	defer rdr.Close()
+	got, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	if expect := "/stream bar " + dir; string(got) != expect {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+	rdr.Close()
+	sm.Close()
+	if !strings.Contains(logbuf.String(), "source /stream stderr: oops\n") {
+		t.Errorf("stderr not logged: %q", logbuf.String())
+	}
+}
+
+func TestExecOptionsPath(t *testing.T) {
+	for _, c := range []struct {
+		c    *Config
+		want []string
+	}{
+		{&Config{Name: "/stream", Path: "/dev/stdin"}, []string{"STREAMSERVE_SOURCE=src", "STREAMSERVE_PATH=/stream"}},
+		{&Config{Path: "/dev/stdin"}, []string{"STREAMSERVE_SOURCE=src"}},
+	} {
+		if got := c.c.execOptions("src").env; !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: got %q, want %q", c.c, got, c.want)
+		}
+	}
+}
+
+func TestExecPgroup(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/stream", &Config{
+		Args:         []string{"sh", "-c", "sleep 60 & printf %08d $!; wait"},
+		ExecFlag:     true,
+		ExecPgroup:   true,
+		CloseIdle:    true,
+		FrameBytes:   8,
+		SourceBuffer: 10,
+	})
+	buf := make([]byte, 8)
+	if _, err := rdr.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil || bytes.Contains(stat, []byte(") Z ")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("grandchild %d still running", pid)
+			break
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// startFiller starts sending filler frames (see -filler) to clients
+// at the stream's real-time rate, while run() reopens the input and
+// waits for its first frame. It returns a function that stops the
+// filler and waits for it to finish, or nil if there is nothing to
+// send.
+func (s *Source) startFiller() (stop func()) {
+	next := s.fillerFunc()
+	if next == nil {
+		return nil
+	}
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.Now()
+		for !s.gone {
+			data := next()
+			if data == nil {
+				return
+			}
+			f := s.ring.newFrame()
+			f.data = f.data[:copy(f.data, data)]
+			var d time.Duration
+			if s.duration != nil {
+				d = s.duration(f.data)
+			} else if bw := s.bandwidth; bw > 0 {
+				d = time.Duration(uint64(len(f.data)) * uint64(time.Second) / bw)
+			}
+			if d <= 0 {
+				// Can't pace the filler.
+				f.pool.Put(f)
+				return
+			}
+			if s.duration != nil {
+				f.duration = d
+			} else {
+				f.duration = 0
+			}
+			s.ring.publish(f, s.nextFrame)
+			atomic.AddUint64(&s.nextFrame, 1)
+			atomic.AddUint64(&s.statFillerFrames, 1)
+			s.Cond.Broadcast()
+			s.wakePool()
+			t = t.Add(d)
+			select {
+			case <-stopped:
+				return
+			case <-time.After(time.Until(t)):
+			}
+		}
+	}()
+	log.Printf("source %s sending filler (%s)", s.label, s.filler)
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+// endFiller stops the filler, if it's running, so run() can publish
+// frames from the input again.
+func (s *Source) endFiller() {
+	if s.stopFiller != nil {
+		s.stopFiller()
+		s.stopFiller = nil
+	}
+}
+
+// fillerFunc returns a function that returns the next filler frame,
+// or nil if the source has no filler.
+func (s *Source) fillerFunc() func() []byte {
+	switch s.filler {
+	case "":
+		return nil
+	case "silence":
+		silence := Silences[s.filterName]
+		if silence == nil {
+			return nil
+		}
+		var last []byte
+		if f := s.ring.get(atomic.LoadUint64(&s.nextFrame) - 1); f != nil {
+			last = append(last, f.data...)
+			f.release()
+		}
+		data := silence(last, int(s.frameBytes))
+		if data == nil {
+			return nil
+		}
+		return func() []byte { return data }
+	default:
+		frames, err := s.loadFillerFile()
+		if err != nil {
+			log.Printf("source %s filler: %s", s.label, err)
+			return nil
+		}
+		i := 0
+		return func() []byte {
+			i++
+			return frames[(i-1)%len(frames)]
+		}
+	}
+}
+
+// loadFillerFile reads the -filler file, and splits it into frames
+// using the source's frame filter. The frames are kept for next
+// time.
+func (s *Source) loadFillerFile() ([][]byte, error) {
+	if s.fillerPath == s.filler && len(s.fillerFrames) > 0 {
+		return s.fillerFrames, nil
+	}
+	buf, err := ioutil.ReadFile(s.filler)
+	if err != nil {
+		return nil, err
+	}
+	frames := splitFrames(buf, s.filter, int(s.frameBytes))
+	if len(frames) == 0 {
+		return nil, errors.New(s.filler + ": no valid frames")
+	}
+	s.fillerPath, s.fillerFrames = s.filler, frames
+	return frames, nil
+}
+
+// splitFrames returns the valid frames in buf, according to filter,
+// skipping invalid data.
+func splitFrames(buf []byte, filter FilterFunc, frameBytes int) (frames [][]byte) {
+	var ctx interface{}
+	scratch := make([]byte, frameBytes)
+	for len(buf) > 0 {
+		n := copy(scratch, buf)
+		size, nextCtx, err := filter(scratch[:n], ctx)
+		if skip, ok := err.(*SkipError); ok {
+			if skip.Bytes > len(buf) {
+				skip.Bytes = len(buf)
+			}
+			buf = buf[skip.Bytes:]
+			continue
+		}
+		switch err {
+		case nil:
+			frames = append(frames, buf[:size])
+			buf = buf[size:]
+			ctx = nextCtx
+		case ErrInvalidFrame, ErrRejectedFrame:
+			buf = buf[1:]
+		default:
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMp3Silence(t *testing.T) {
+	// 128 kbps, 44100 Hz, with padding and CRC
+	last := []byte{0xff, 0xfa, 0x92, 0x64, 1, 2, 3}
+	frame := Mp3Silence(last, 2048)
+	if len(frame) != 417 {
+		t.Fatalf("expected 417 bytes, got %d", len(frame))
+	}
+	if !bytes.Equal(frame[:4], []byte{0xff, 0xfb, 0x90, 0x64}) {
+		t.Errorf("header %x", frame[:4])
+	}
+	if !bytes.Equal(frame[4:], make([]byte, 413)) {
+		t.Error("non-zero data")
+	}
+	if Mp3Silence(nil, 2048) != nil {
+		t.Error("expected nil without a previous frame")
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	frames := splitFrames(make([]byte, 40), RawFilter, 16)
+	if len(frames) != 2 || len(frames[0]) != 16 || len(frames[1]) != 16 {
+		t.Errorf("raw: got %d frames", len(frames))
+	}
+	frame := Mp3Silence([]byte{0xff, 0xfb, 0x90, 0x64}, 2048)
+	buf := bytes.Join([][]byte{id3v2Tag(3000), []byte("junk"), frame, frame}, nil)
+	if frames := splitFrames(buf, Mp3Filter, 2048); len(frames) != 2 || !bytes.Equal(frames[1], frame) {
+		t.Errorf("mp3: got %d frames", len(frames))
+	}
+}
+
+// fillerReader returns a reader for a source that sends 100 frames
+// of "a", then restarts after a delay.
+func fillerReader(t *testing.T, filler string) (*SourceMap, *SourceReader) {
+	sm := NewSourceMap()
+	rdr := sm.NewReader("primary", &Config{
+		Args:            []string{"sh", "-c", "sleep 0.3; yes a | tr -d '\\n' | head -c 1600"},
+		ExecFlag:        true,
+		CloseIdle:       true,
+		Filler:          filler,
+		FrameBytes:      16,
+		Reopen:          true,
+		SourceBandwidth: 16000,
+		SourceBuffer:    50,
+	})
+	return sm, rdr
+}
+
+func TestFillerSilence(t *testing.T) {
+	sm, rdr := fillerReader(t, "silence")
+	defer sm.Close()
+	defer rdr.Close()
+	readFrameKinds(t, rdr, 5*time.Second, 'a', 0, 'a')
+	// About 300 ms at 1000 frames per second.
+	if n := atomic.LoadUint64(&rdr.source.statFillerFrames); n < 100 || n > 1000 {
+		t.Errorf("sent %d filler frames", n)
+	}
+}
+
+func TestFillerFile(t *testing.T) {
+	fn := writeTestFile(t, bytes.Repeat([]byte("f"), 32))
+	sm, rdr := fillerReader(t, fn)
+	defer sm.Close()
+	defer rdr.Close()
+	readFrameKinds(t, rdr, 5*time.Second, 'a', 'f', 'a')
+}
+
+func TestFillerNone(t *testing.T) {
+	sm, rdr := fillerReader(t, "")
+	defer sm.Close()
+	defer rdr.Close()
+	readFrameKinds(t, rdr, 5*time.Second, 'a')
+	if rdr.source.startFiller() != nil {
+		t.Error("expected no filler")
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 // FilterFunc indicates whether the given buf starts with a valid
 // frame. If so, it returns the size of the valid frame and err==nil.
 //
-// If not, it returns a non-nil error.
+// If not, it returns a non-nil error: ErrInvalidFrame,
+// ErrRejectedFrame, ErrShortFrame, or a *SkipError.
 //
 // The nextContext returned by a FilterFunc is passed to the same
 // FilterFunc as contextIn next time the FilterFunc is called to
@@ -18,6 +21,12 @@ type FilterFunc func(buf []byte, contextIn interface{}) (frameSize int, nextCont
 // be a prefix of any valid frame.
 var ErrInvalidFrame = errors.New("Not a valid frame")
 
+// ErrRejectedFrame indicates the supplied buf starts with something
+// that could be a frame, but failed a stricter check (see
+// NewMp3Filter). Like ErrInvalidFrame, it means the caller should
+// look for a frame starting at the next byte.
+var ErrRejectedFrame = errors.New("Rejected frame")
+
 // ErrShortFrame indicates it is possible that the supplied buf is a
 // prefix of a valid frame, but more data must be supplied in order to
 // identify such a frame.
@@ -26,12 +35,79 @@ var ErrInvalidFrame = errors.New("Not a valid frame")
 // than the supplied buf, or begin with buf.
 var ErrShortFrame = errors.New("Short frame")
 
+// A SkipError indicates that buf starts with data that isn't part of
+// the stream, like a tag, which should be discarded. Bytes is the
+// size of that data, which can be more than len(buf). Meta is the
+// metadata found in the data, if any.
+type SkipError struct {
+	Bytes int
+	Meta  *Metadata
+}
+
+func (e *SkipError) Error() string {
+	return fmt.Sprintf("skip %d bytes", e.Bytes)
+}
+
 // Filters is a map of named FilterFuncs which can be selected by
 // callers.
 var Filters = map[string]FilterFunc{
 	"": RawFilter,
 }
 
+// DurationFunc returns the media duration (playing time) of a frame
+// accepted by the FilterFunc with the same name.
+type DurationFunc func(frame []byte) time.Duration
+
+// Durations is a map of named DurationFuncs, for the Filters whose
+// frames have a known duration.
+var Durations = map[string]DurationFunc{}
+
+// rawDuration returns a DurationFunc for raw frames of media at the
+// given rate (see -raw-byte-rate).
+func rawDuration(byteRate uint64) DurationFunc {
+	return func(frame []byte) time.Duration {
+		return time.Duration(uint64(len(frame)) * uint64(time.Second) / byteRate)
+	}
+}
+
+// filterFunc returns the FilterFunc for c.FrameFilter, with c's
+// filter options (like -mp3-sync).
+func (c *Config) filterFunc() FilterFunc {
+	if c.FrameFilter == "mp3" && (c.Mp3Sync > 0 || c.Mp3CRC) {
+		return NewMp3Filter(c.Mp3Sync, c.Mp3CRC)
+	}
+	return Filters[c.FrameFilter]
+}
+
+// durationFunc returns the DurationFunc for c's frames, or nil if
+// their durations are unknown.
+func (c *Config) durationFunc() DurationFunc {
+	if d := Durations[c.FrameFilter]; d != nil {
+		return d
+	}
+	if c.FrameFilter == "" && c.RawByteRate > 0 {
+		return rawDuration(c.RawByteRate)
+	}
+	return nil
+}
+
+// SilenceFunc returns a frame of silence, with the same parameters
+// as the last frame sent (if any), to send while the input is down
+// (see -filler). It returns nil if it can't.
+type SilenceFunc func(last []byte, frameBytes int) []byte
+
+// Silences is a map of named SilenceFuncs, for the Filters whose
+// streams can be filled with silence.
+var Silences = map[string]SilenceFunc{
+	"": RawSilence,
+}
+
+// RawSilence returns a frame of zeroes, which is silence for signed
+// PCM audio.
+func RawSilence(_ []byte, frameBytes int) []byte {
+	return make([]byte, frameBytes)
+}
+
 // RawFilter passes a frame IFF it fills the frame buffer capacity.
 func RawFilter(frame []byte, _ interface{}) (frameSize int, _ interface{}, err error) {
 	frameSize = cap(frame)
@@ -1,68 +1,223 @@
 package main
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 func init() {
 	Filters["mp3"] = Mp3Filter
+	Durations["mp3"] = Mp3Duration
+	Silences["mp3"] = Mp3Silence
 }
 
 // Mp3Filter accepts valid MPEG audio frames (MPEG-1, -2, -2.5 layer
-// I, II, III).
+// I, II, III). It skips ID3v2, ID3v1, and APE tags.
 //
 // BUG(tomclegg): Mp3Filter does not inspect logical frames, which
 // span several physical frames. To eliminate decoding errors, it
 // should return logical MP3 frames instead of physical frames.
 func Mp3Filter(frame []byte, contextIn interface{}) (frameSize int, context interface{}, err error) {
 	context = contextIn
+	if len(frame) > 0 && frame[0] != '\377' {
+		if err = mp3Tag(frame); err != nil {
+			return
+		}
+	}
 	if len(frame) < 4 {
 		err = ErrShortFrame
 		return
 	}
+	var p mp3Params
+	if p, frameSize, err = mp3Header(frame); err != nil {
+		return
+	}
+	if frameSize > len(frame) {
+		err = ErrShortFrame
+	} else if Debugging {
+		log.Printf("frameSize %d len %d MPEG-%s layer %s samplerate %d", frameSize, len(frame), versionName[p.version], layerName[p.layer], p.samplerate)
+	}
+	return
+}
+
+// mp3Params are the parameters of an MPEG audio stream that don't
+// change from one frame to the next.
+type mp3Params struct {
+	version, layer, samplerate int
+}
+
+// mp3Header parses the 4-byte MPEG audio frame header at the start
+// of frame, and returns the stream parameters and frame size.
+func mp3Header(frame []byte) (p mp3Params, frameSize int, err error) {
 	if frame[0] != '\377' || (frame[1]&'\340') != '\340' {
 		err = ErrInvalidFrame
 		return
 	}
-	version := int(frame[1]>>3) & 3
-	layer := int(frame[1]>>1) & 3
+	p.version = int(frame[1]>>3) & 3
+	p.layer = int(frame[1]>>1) & 3
 	var bitrate int
 	{
 		rate := int(frame[2]>>4) & 15
-		bitrates := bitrateTable[version][layer]
+		bitrates := bitrateTable[p.version][p.layer]
 		if len(bitrates) <= rate || bitrates[rate] <= 0 {
 			err = ErrInvalidFrame
 			return
 		}
 		bitrate = bitrates[rate] * 1000
 	}
-	var samplerate int
 	{
 		rate := int(frame[2]>>2) & 3
-		samplerates := samplerateTable[version]
+		samplerates := samplerateTable[p.version]
 		if len(samplerates) <= rate {
 			err = ErrInvalidFrame
 			return
 		}
-		samplerate = samplerates[rate]
+		p.samplerate = samplerates[rate]
 	}
 	padding := int(frame[2]>>1) & 1
 	switch {
-	case layer == layerI:
-		frameSize = (12*bitrate/samplerate + padding) * 4
-	case layer == layerIII && version != version1:
+	case p.layer == layerI:
+		frameSize = (12*bitrate/p.samplerate + padding) * 4
+	case p.layer == layerIII && p.version != version1:
 		// MPEG-2 layer III and MPEG-2.5 layer III frames are
 		// half the size of other layer II and III frames.
-		frameSize = 72*bitrate/samplerate + padding
+		frameSize = 72*bitrate/p.samplerate + padding
 	default:
-		frameSize = 144*bitrate/samplerate + padding
-	}
-	if frameSize > len(frame) {
-		err = ErrShortFrame
-	} else if Debugging {
-		log.Printf("frameSize %d len %d MPEG-%s layer %s bitrate %d samplerate %d padding %d", frameSize, len(frame), versionName[version], layerName[layer], bitrate, samplerate, padding)
+		frameSize = 144*bitrate/p.samplerate + padding
 	}
 	return
 }
 
+// NewMp3Filter returns a stricter version of Mp3Filter, for inputs
+// that can have glitches.
+//
+// After a glitch (invalid data or a rejected frame), and at the
+// start of the stream, it accepts a frame only if the next sync
+// frame headers have the same MPEG version, layer, and sample rate,
+// or as many of them as fit in the frame buffer. Those parameters
+// are then kept in the filter context, and each frame that follows
+// directly is accepted without looking ahead, as long as it matches.
+// A frame that doesn't match has to be confirmed the same way, so
+// the stream can change parameters (for example, between tracks).
+//
+// If crc is true, it also rejects layer III frames whose CRC-16
+// (present when the header's protection bit is 0) doesn't match.
+//
+// Frames that have a valid header, but fail these checks, are
+// rejected with ErrRejectedFrame.
+func NewMp3Filter(sync int, crc bool) FilterFunc {
+	return func(frame []byte, contextIn interface{}) (frameSize int, context interface{}, err error) {
+		frameSize, context, err = Mp3Filter(frame, contextIn)
+		if err == ErrInvalidFrame {
+			// Glitch: resync at the next frame.
+			return 0, nil, err
+		} else if err != nil {
+			return
+		}
+		p, _, _ := mp3Header(frame)
+		if crc && !mp3CRCOK(frame[:frameSize]) {
+			return 0, nil, ErrRejectedFrame
+		}
+		if lock, ok := contextIn.(mp3Params); ok && lock == p {
+			return
+		}
+		pos := frameSize
+		for i := 0; i < sync; i++ {
+			if pos+4 > len(frame) {
+				if len(frame) < cap(frame) {
+					return 0, contextIn, ErrShortFrame
+				}
+				// The frame buffer is full.
+				break
+			}
+			next, size, err := mp3Header(frame[pos:])
+			if err != nil || next != p {
+				return 0, nil, ErrRejectedFrame
+			}
+			pos += size
+		}
+		return frameSize, p, nil
+	}
+}
+
+// mp3CRCOK returns false if frame is a layer III frame with a CRC-16
+// that doesn't match its header and side information.
+func mp3CRCOK(frame []byte) bool {
+	p, _, _ := mp3Header(frame)
+	if frame[1]&1 != 0 || p.layer != layerIII {
+		// No CRC, or not layer III
+		return true
+	}
+	mono := frame[3]>>6 == 3
+	var sideInfo int
+	switch {
+	case p.version == version1 && mono:
+		sideInfo = 17
+	case p.version == version1:
+		sideInfo = 32
+	case mono:
+		sideInfo = 9
+	default:
+		sideInfo = 17
+	}
+	if len(frame) < 6+sideInfo {
+		return false
+	}
+	sum := crc16(0xffff, frame[2:4])
+	sum = crc16(sum, frame[6:6+sideInfo])
+	return sum == uint16(frame[4])<<8|uint16(frame[5])
+}
+
+// crc16 updates an MPEG audio CRC-16 (polynomial 0x8005) with the
+// given data.
+func crc16(sum uint16, data []byte) uint16 {
+	for _, b := range data {
+		for bit := 7; bit >= 0; bit-- {
+			carry := sum>>15 ^ uint16(b>>uint(bit))&1
+			sum <<= 1
+			if carry != 0 {
+				sum ^= 0x8005
+			}
+		}
+	}
+	return sum
+}
+
+// Mp3Duration returns the playing time of an MPEG audio frame
+// accepted by Mp3Filter.
+func Mp3Duration(frame []byte) time.Duration {
+	version := int(frame[1]>>3) & 3
+	layer := int(frame[1]>>1) & 3
+	samplerate := samplerateTable[version][int(frame[2]>>2)&3]
+	samples := 1152
+	switch {
+	case layer == layerI:
+		samples = 384
+	case layer == layerIII && version != version1:
+		samples = 576
+	}
+	return time.Duration(samples) * time.Second / time.Duration(samplerate)
+}
+
+// Mp3Silence returns a silent MPEG audio frame with the same
+// version, layer, bitrate, sample rate, and channel mode as the
+// last frame. The frame has no CRC or padding, and its side
+// information and audio data are all zero, which decodes as silence.
+func Mp3Silence(last []byte, frameBytes int) []byte {
+	if len(last) < 4 {
+		return nil
+	}
+	frame := make([]byte, frameBytes)
+	copy(frame, last[:4])
+	frame[1] |= 1       // protection bit: no CRC
+	frame[2] &^= 1 << 1 // no padding
+	size, _, err := Mp3Filter(frame, nil)
+	if err != nil {
+		return nil
+	}
+	return frame[:size]
+}
+
 const (
 	layerI     = 3
 	layerII    = 2
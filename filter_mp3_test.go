@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 var v1bits = 3 << 3
 var v2bits = 2 << 3
@@ -69,3 +76,112 @@ func shouldFilter(t *testing.T, fSize int, header ...byte) {
 		t.Errorf("Short frame (%d, %v) returned %d, %s", fSize-1, header, fs, err)
 	}
 }
+
+func TestMp3Duration(t *testing.T) {
+	for _, trial := range []struct {
+		header []byte
+		expect time.Duration
+	}{
+		{[]byte{0377, byte(0340 | v1bits | lIIIbits), byte(9<<brShift | 0<<srShift)}, 1152 * time.Second / 44100},
+		{[]byte{0377, byte(0340 | v1bits | lIbits), byte(4<<brShift | 1<<srShift)}, 384 * time.Second / 48000},
+		{[]byte{0377, byte(0340 | v2bits | lIIIbits), byte(14<<brShift | 2<<srShift)}, 576 * time.Second / 16000},
+		{[]byte{0377, byte(0340 | v25bits | lIIbits), byte(13<<brShift | 0<<srShift)}, 1152 * time.Second / 11025},
+	} {
+		if d := Mp3Duration(trial.header); d != trial.expect {
+			t.Errorf("%x: expected %s, got %s", trial.header, trial.expect, d)
+		}
+	}
+}
+
+func TestMp3SyncFilter(t *testing.T) {
+	frame := testMp3Frame()
+	// 128 kbps, 48000 Hz
+	frame48 := make([]byte, 384)
+	copy(frame48, []byte{0xff, 0xfb, 0x94, 0x64})
+	lock44 := mp3Params{version1, layerIII, 44100}
+	lock48 := mp3Params{version1, layerIII, 48000}
+	filter := NewMp3Filter(2, false)
+	for i, trial := range []struct {
+		buf     []byte
+		cap     int
+		ctx     interface{}
+		size    int
+		nextCtx interface{}
+		err     error
+	}{
+		{buf: bytes.Repeat(frame, 3), cap: 2048, size: 417, nextCtx: lock44},
+		{buf: append(append([]byte{}, frame...), make([]byte, 417)...), cap: 2048, err: ErrRejectedFrame},
+		{buf: append(append([]byte{}, frame...), frame48...), cap: 2048, err: ErrRejectedFrame},
+		{buf: append(append([]byte{}, frame...), frame[:3]...), cap: 2048, err: ErrShortFrame},
+		{buf: append(append([]byte{}, frame...), frame[:100]...), cap: 517, size: 417, nextCtx: lock44},
+		{buf: frame, cap: 2048, ctx: lock44, size: 417, nextCtx: lock44},
+		{buf: frame48, cap: 2048, ctx: lock44, nextCtx: lock44, err: ErrShortFrame},
+		{buf: bytes.Repeat(frame48, 3), cap: 2048, ctx: lock44, size: 384, nextCtx: lock48},
+	} {
+		buf := make([]byte, len(trial.buf), trial.cap)
+		copy(buf, trial.buf)
+		size, ctx, err := filter(buf, trial.ctx)
+		if err != trial.err || (err == nil && size != trial.size) || (trial.nextCtx != nil && ctx != trial.nextCtx) {
+			t.Errorf("trial %d: got %d, %v, %v", i, size, ctx, err)
+		}
+	}
+}
+
+func TestMp3CRC(t *testing.T) {
+	if sum := crc16(0xffff, []byte("123456789")); sum != 0xaee7 {
+		t.Errorf("crc16 check value %x", sum)
+	}
+	// MPEG-1 layer III, joint stereo, with CRC
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfa, 0x90, 0x64})
+	for i := 6; i < 6+32; i++ {
+		frame[i] = byte(i * 7)
+	}
+	sum := crc16(crc16(0xffff, frame[2:4]), frame[6:38])
+	frame[4], frame[5] = byte(sum>>8), byte(sum)
+	filter := NewMp3Filter(0, true)
+	if _, _, err := filter(frame, nil); err != nil {
+		t.Errorf("good CRC: %v", err)
+	}
+	frame[20]++
+	if _, _, err := filter(frame, nil); err != ErrRejectedFrame {
+		t.Errorf("bad CRC: %v", err)
+	}
+	// Frames without CRC are not checked.
+	frame[1] |= 1
+	if _, _, err := filter(frame, nil); err != nil {
+		t.Errorf("no CRC: %v", err)
+	}
+}
+
+func TestMp3SyncSource(t *testing.T) {
+	frame := testMp3Frame()
+	// A glitch, then junk that starts with a valid header, but
+	// isn't followed by another frame.
+	junk := make([]byte, 200)
+	copy(junk[3:], frame[:4])
+	fn := writeTestFile(t, bytes.Join([][]byte{bytes.Repeat(frame, 5), junk, bytes.Repeat(frame, 5)}, nil))
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{
+		SourceBuffer: 100,
+		FrameBytes:   2048,
+		FrameFilter:  "mp3",
+		Mp3Sync:      2,
+		CloseIdle:    true,
+	})
+	defer rdr.Close()
+	n, err := io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 10*417 {
+		t.Errorf("expected %d bytes, got %d", 10*417, n)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statFramesRejected); n != 1 {
+		t.Errorf("expected 1 rejected frame, got %d", n)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statBytesInvalid); n != 200 {
+		t.Errorf("expected 200 invalid bytes, got %d", n)
+	}
+}
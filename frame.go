@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A frame holds one frame of source data. Once a frame is published
+// in a source's ring buffer, its data does not change until every
+// reader holding a reference has released it, so readers can write
+// it to their clients without copying it first.
+type frame struct {
+	data []byte
+	seq  uint64 // position in the source's stream (see Source.nextFrame)
+	// Number of references held: one for the ring buffer slot,
+	// plus one for each reader currently using the frame. When
+	// refs reaches zero, the frame goes back to the pool, and can
+	// be overwritten.
+	refs      int32
+	pool      *sync.Pool
+	published time.Time     // when the frame was published in the ring
+	duration  time.Duration // playing time, if known (see Durations)
+}
+
+// acquire adds a reference to the frame. It returns false if the
+// frame has already been released by everyone, and might be getting
+// overwritten.
+func (f *frame) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&f.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&f.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the frame. When the last reference is
+// dropped, the frame's buffer becomes available for reuse.
+func (f *frame) release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		f.pool.Put(f)
+	}
+}
+
+// ring is a fixed-size ring buffer of frames. Each slot holds the
+// most recent frame whose seq maps to that slot.
+type ring struct {
+	slots []atomic.Pointer[frame]
+	pool  sync.Pool
+	// If not nil, evicted is called with each frame that is
+	// replaced by publish, before the ring's reference to it is
+	// released.
+	evicted func(*frame)
+}
+
+func newRing(nFrames, frameBytes uint64) *ring {
+	r := &ring{slots: make([]atomic.Pointer[frame], nFrames)}
+	r.pool.New = func() interface{} {
+		return &frame{data: make([]byte, frameBytes), pool: &r.pool}
+	}
+	return r
+}
+
+// Len returns the number of slots in the ring.
+func (r *ring) Len() int {
+	return len(r.slots)
+}
+
+// newFrame returns an unpublished frame whose data buffer can hold
+// frameBytes bytes.
+func (r *ring) newFrame() *frame {
+	f := r.pool.Get().(*frame)
+	f.data = f.data[:cap(f.data)]
+	return f
+}
+
+// publish puts f in the ring as frame number seq, replacing (and
+// releasing) the frame that was there before. Only one goroutine
+// (the source's run loop) may call publish.
+func (r *ring) publish(f *frame, seq uint64) {
+	f.seq = seq
+	f.published = time.Now()
+	atomic.StoreInt32(&f.refs, 1)
+	slot := &r.slots[seq%uint64(len(r.slots))]
+	old := slot.Load()
+	if old != nil && r.evicted != nil {
+		// Call evicted before replacing old, so a reader that
+		// doesn't find old in the ring can find it wherever
+		// evicted put it.
+		r.evicted(old)
+	}
+	slot.Store(f)
+	if old != nil {
+		old.release()
+	}
+}
+
+// get returns frame number seq with a reference held, or nil if
+// that frame is no longer (or not yet) in the ring. The caller must
+// release the returned frame.
+func (r *ring) get(seq uint64) *frame {
+	f := r.slots[seq%uint64(len(r.slots))].Load()
+	if f == nil || !f.acquire() {
+		return nil
+	}
+	if f.seq != seq {
+		f.release()
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRingHeldFrameNotOverwritten(t *testing.T) {
+	r := newRing(3, 4)
+	publish := func(seq uint64) {
+		f := r.newFrame()
+		for i := range f.data {
+			f.data[i] = byte(seq)
+		}
+		r.publish(f, seq)
+	}
+	publish(0)
+	held := r.get(0)
+	if held == nil {
+		t.Fatal("frame 0 not in ring")
+	}
+	for seq := uint64(1); seq < 10; seq++ {
+		publish(seq)
+	}
+	if !bytes.Equal(held.data, []byte{0, 0, 0, 0}) {
+		t.Errorf("held frame was overwritten: %v", held.data)
+	}
+	if f := r.get(0); f != nil {
+		t.Error("got frame 0 after it was replaced")
+	}
+	if f := r.get(10); f != nil {
+		t.Error("got frame 10 before it was published")
+	}
+	f := r.get(9)
+	if f == nil || f.data[0] != 9 {
+		t.Fatalf("got frame %v, expected frame 9", f)
+	}
+	f.release()
+	held.release()
+	if held.acquire() {
+		t.Error("acquired a frame after it was released by everyone")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3v2Size returns the size of the ID3v2 tag (including its header
+// and footer) at the start of buf, or 0 if buf doesn't start with an
+// ID3v2 tag header. buf must hold at least the 10-byte header.
+func id3v2Size(buf []byte) int {
+	if len(buf) < 10 || !bytes.HasPrefix(buf, []byte("ID3")) ||
+		buf[3] == 0xff || buf[4] == 0xff ||
+		(buf[6]|buf[7]|buf[8]|buf[9])&0x80 != 0 {
+		return 0
+	}
+	size := syncsafe(buf[6:10]) + 10
+	if buf[5]&0x10 != 0 {
+		// Footer present
+		size += 10
+	}
+	return size
+}
+
+// id3v1Size is the size of an ID3v1 tag, which is at the end of a
+// file and starts with "TAG".
+const id3v1Size = 128
+
+// apeFooterSize is the size of an APEv1/APEv2 tag footer, which is
+// at the end of the tag.
+const apeFooterSize = 32
+
+// apeTagSize returns the size of the APE tag (including its header,
+// if any) whose 32-byte footer is at the start of footer, or 0 if
+// footer isn't an APE tag footer.
+func apeTagSize(footer []byte) int {
+	if len(footer) < apeFooterSize || !bytes.HasPrefix(footer, []byte("APETAGEX")) {
+		return 0
+	}
+	// Size includes the footer and items, but not the header.
+	size := int(binary.LittleEndian.Uint32(footer[12:16]))
+	if flags := binary.LittleEndian.Uint32(footer[20:24]); flags&(1<<31) != 0 {
+		size += apeFooterSize
+	}
+	return size
+}
+
+// tagBounds returns the start and end of the audio data in a file of
+// the given size, excluding an ID3v2 tag at the start, and APE and
+// ID3v1 tags at the end.
+func tagBounds(r io.ReaderAt, size int64) (start, end int64, err error) {
+	end = size
+	buf := make([]byte, id3v1Size)
+	if n, err := r.ReadAt(buf[:10], 0); n == 10 {
+		start = int64(id3v2Size(buf[:10]))
+	} else if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if end-start >= id3v1Size {
+		if _, err := r.ReadAt(buf, end-id3v1Size); err != nil {
+			return 0, 0, err
+		}
+		if bytes.HasPrefix(buf, []byte("TAG")) {
+			end -= id3v1Size
+		}
+	}
+	if end-start >= apeFooterSize {
+		if _, err := r.ReadAt(buf[:apeFooterSize], end-apeFooterSize); err != nil {
+			return 0, 0, err
+		}
+		if ape := int64(apeTagSize(buf)); ape > 0 && ape <= end-start {
+			end -= ape
+		}
+	}
+	if start > end {
+		start = end
+	}
+	return start, end, nil
+}
+
+// Metadata describes the current content of a stream, as found in
+// tags in the input.
+type Metadata struct {
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+}
+
+// setMetadata records metadata found in the source's input, if
+// -tag-metadata is enabled.
+func (s *Source) setMetadata(m *Metadata) {
+	if m == nil || !s.tagMetadata {
+		return
+	}
+	if old := s.metadata.Load(); old != nil && *old == *m {
+		return
+	}
+	s.metadata.Store(m)
+	log.Printf("source %s now playing: title %q, artist %q", s.label, m.Title, m.Artist)
+}
+
+// mp3Tag checks whether buf starts with an ID3v2, ID3v1, or APE tag.
+// It returns a *SkipError giving the size of the tag (which can be
+// bigger than buf) and any title and artist found in it,
+// ErrShortFrame if more data is needed to tell, or nil if buf
+// doesn't start with a tag.
+func mp3Tag(buf []byte) error {
+	for _, magic := range []string{"ID3", "TAG", "APETAGEX"} {
+		if len(buf) < len(magic) && bytes.HasPrefix([]byte(magic), buf) {
+			return ErrShortFrame
+		}
+	}
+	switch {
+	case bytes.HasPrefix(buf, []byte("ID3")):
+		if len(buf) < 10 {
+			return ErrShortFrame
+		}
+		if size := id3v2Size(buf); size > 0 {
+			if len(buf) > size {
+				buf = buf[:size]
+			}
+			return &SkipError{Bytes: size, Meta: parseID3v2(buf)}
+		}
+	case bytes.HasPrefix(buf, []byte("TAG")):
+		// "TAG" can turn up in garbage while resyncing, so
+		// only take it for a tag if a frame or another tag
+		// follows (unless the frame buffer is too small to
+		// tell).
+		if len(buf) < id3v1Size+4 && len(buf) < cap(buf) {
+			return ErrShortFrame
+		}
+		if len(buf) >= id3v1Size+4 && !mp3FrameOrTag(buf[id3v1Size:]) {
+			return nil
+		}
+		return &SkipError{Bytes: id3v1Size, Meta: parseID3v1(buf)}
+	case bytes.HasPrefix(buf, []byte("APETAGEX")):
+		if len(buf) < apeFooterSize {
+			return ErrShortFrame
+		}
+		if flags := binary.LittleEndian.Uint32(buf[20:24]); flags&(1<<29) == 0 {
+			// This is the footer at the end of the tag;
+			// the items before it have already gone by.
+			return &SkipError{Bytes: apeFooterSize}
+		}
+		return &SkipError{Bytes: apeTagSize(buf)}
+	}
+	return nil
+}
+
+// mp3FrameOrTag returns true if buf (at least 4 bytes) starts with
+// an MPEG audio frame sync or a tag.
+func mp3FrameOrTag(buf []byte) bool {
+	if buf[0] == '\377' && buf[1]&'\340' == '\340' {
+		return true
+	}
+	for _, magic := range []string{"ID3", "TAG", "APET"} {
+		if bytes.HasPrefix(buf, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseID3v1 returns the title and artist from an ID3v1 tag, or nil
+// if buf doesn't hold the whole tag.
+func parseID3v1(buf []byte) *Metadata {
+	if len(buf) < id3v1Size {
+		return nil
+	}
+	trim := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(latin1(b))
+	}
+	return metadataOrNil(trim(buf[3:33]), trim(buf[33:63]))
+}
+
+// parseID3v2 returns the title and artist from the text frames in
+// an ID3v2.2, v2.3, or v2.4 tag, or as much of it as is in buf.
+func parseID3v2(buf []byte) *Metadata {
+	version := buf[3]
+	pos := 10
+	if buf[5]&0x40 != 0 && version >= 3 && len(buf) >= 14 {
+		// Skip the extended header.
+		size := int(binary.BigEndian.Uint32(buf[10:14]))
+		if version == 3 {
+			size += 4 // size doesn't include itself
+		} else {
+			size = syncsafe(buf[10:14])
+		}
+		pos += size
+	}
+	idLen, hdrLen := 4, 10
+	titleID, artistID := "TIT2", "TPE1"
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+		titleID, artistID = "TT2", "TP1"
+	}
+	var title, artist string
+	for pos+hdrLen <= len(buf) && buf[pos] != 0 {
+		id := string(buf[pos : pos+idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(buf[pos+3])<<16 | int(buf[pos+4])<<8 | int(buf[pos+5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(buf[pos+4 : pos+8]))
+		default:
+			size = syncsafe(buf[pos+4 : pos+8])
+		}
+		pos += hdrLen
+		if size < 0 || pos+size > len(buf) {
+			break
+		}
+		switch id {
+		case titleID:
+			title = id3Text(buf[pos : pos+size])
+		case artistID:
+			artist = id3Text(buf[pos : pos+size])
+		}
+		pos += size
+	}
+	return metadataOrNil(title, artist)
+}
+
+func metadataOrNil(title, artist string) *Metadata {
+	if title == "" && artist == "" {
+		return nil
+	}
+	return &Metadata{Title: title, Artist: artist}
+}
+
+// syncsafe decodes a 4-byte ID3v2 "syncsafe" integer (7 bits per
+// byte).
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Text decodes the content of an ID3v2 text frame: an encoding
+// byte, followed by text (possibly several NUL-separated strings, of
+// which only the first is returned).
+func id3Text(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	var s string
+	switch enc {
+	case 1, 2:
+		// UTF-16 with BOM, or UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		s = string(utf16.Decode(u))
+	case 3:
+		s = string(b)
+	default:
+		s = latin1(b)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// latin1 decodes ISO-8859-1 text.
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
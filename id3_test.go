@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+)
+
+// id3v23Tag returns an ID3v2.3 tag with the given text frames (ID,
+// encoding byte, text), followed by padding.
+func id3v23Tag(padding int, frames ...string) []byte {
+	var body []byte
+	for _, f := range frames {
+		hdr := make([]byte, 10)
+		copy(hdr, f[:4])
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(f)-4))
+		body = append(append(body, hdr...), f[4:]...)
+	}
+	body = append(body, make([]byte, padding)...)
+	tag := id3v2Tag(len(body))
+	tag[3] = 3
+	copy(tag[10:], body)
+	return tag
+}
+
+func TestMp3Tag(t *testing.T) {
+	id3v1 := make([]byte, id3v1Size)
+	copy(id3v1, "TAGSome title")
+	copy(id3v1[33:], "Someone\x00\x00junk")
+	ape := apeTag(50)
+	for _, trial := range []struct {
+		buf   []byte
+		err   error
+		bytes int
+		meta  *Metadata
+	}{
+		{buf: []byte{0xff, 0xfb, 0x90, 0x64}},
+		{buf: []byte("junk")},
+		{buf: []byte("ID"), err: ErrShortFrame},
+		{buf: []byte("ID3\x03\x00\x00"), err: ErrShortFrame},
+		{buf: []byte("APETAG"), err: ErrShortFrame},
+		{buf: id3v1[:100], err: ErrShortFrame},
+		{buf: id3v1, bytes: 128, meta: &Metadata{Title: "Some title", Artist: "Someone"}},
+		{buf: append(id3v1[:128:128], 0xff, 0xfb, 0x90, 0x64), bytes: 128, meta: &Metadata{Title: "Some title", Artist: "Someone"}},
+		{buf: append(id3v1[:128:128], "ID3\x03"...), bytes: 128, meta: &Metadata{Title: "Some title", Artist: "Someone"}},
+		{buf: append(append(make([]byte, 0, 2048), id3v1...), 0xff), err: ErrShortFrame},
+		{buf: append(id3v1[:128:128], "junk"...)},
+		{buf: id3v2Tag(5000)[:100], bytes: 5010},
+		{buf: id3v23Tag(100, "TIT2\x00Title", "TPE1\x01\xff\xfeA\x00r\x00t\x00"), bytes: 145, meta: &Metadata{Title: "Title", Artist: "Art"}},
+		{buf: ape, bytes: len(ape)},
+		{buf: ape[len(ape)-apeFooterSize:], bytes: apeFooterSize},
+	} {
+		err := mp3Tag(trial.buf)
+		skip, ok := err.(*SkipError)
+		if trial.bytes == 0 {
+			if err != trial.err {
+				t.Errorf("%q: expected %v, got %v", trial.buf, trial.err, err)
+			}
+		} else if !ok {
+			t.Errorf("%q: expected SkipError, got %v", trial.buf, err)
+		} else if skip.Bytes != trial.bytes {
+			t.Errorf("%q: expected to skip %d, got %d", trial.buf, trial.bytes, skip.Bytes)
+		} else if (skip.Meta == nil) != (trial.meta == nil) || (skip.Meta != nil && *skip.Meta != *trial.meta) {
+			t.Errorf("%q: expected %+v, got %+v", trial.buf, trial.meta, skip.Meta)
+		}
+	}
+}
+
+func TestParseID3v22(t *testing.T) {
+	tag := []byte("ID3\x02\x00\x00\x00\x00\x00\x14TT2\x00\x00\x04\x00abcTP1\x00\x00\x02\x00d")
+	if m := parseID3v2(tag); m == nil || *m != (Metadata{Title: "abc", Artist: "d"}) {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestTaggedMp3Source(t *testing.T) {
+	frame := testMp3Frame()
+	// The tag is bigger than a frame buffer, and its padding
+	// starts with something that looks like an MP3 frame.
+	tag := id3v23Tag(5000, "TIT2\x03Title", "TPE1\x00Artist")
+	copy(tag[len(tag)-5000:], frame[:4])
+	fn := writeTestFile(t, bytes.Join([][]byte{tag, bytes.Repeat(frame, 10), apeTag(50), frame, frame}, nil))
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{
+		SourceBuffer: 100,
+		FrameBytes:   2048,
+		FrameFilter:  "mp3",
+		CloseIdle:    true,
+		TagMetadata:  true,
+	})
+	defer rdr.Close()
+	n, err := io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 12*417 {
+		t.Errorf("expected %d bytes, got %d", 12*417, n)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statBytesInvalid); n != 0 {
+		t.Errorf("%d invalid bytes", n)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statBytesTags); n != uint64(len(tag)+50+2*apeFooterSize) {
+		t.Errorf("skipped %d tag bytes", n)
+	}
+	if m := rdr.source.metadata.Load(); m == nil || *m != (Metadata{Title: "Title", Artist: "Artist"}) {
+		t.Errorf("metadata %+v", m)
+	}
+}
+
+func TestMp3TagInGarbage(t *testing.T) {
+	frame := testMp3Frame()
+	// "TAG" in garbage, less than an ID3v1 tag's length before
+	// the next frame, shouldn't make the filter skip into it.
+	fn := writeTestFile(t, bytes.Join([][]byte{frame, []byte("xxTAGxx"), frame, frame, frame}, nil))
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{
+		SourceBuffer: 100,
+		FrameBytes:   2048,
+		FrameFilter:  "mp3",
+		CloseIdle:    true,
+	})
+	defer rdr.Close()
+	n, err := io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 4*int64(len(frame)) {
+		t.Errorf("expected %d bytes, got %d", 4*len(frame), n)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statBytesTags); n != 0 {
+		t.Errorf("skipped %d tag bytes", n)
+	}
+}
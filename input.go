@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrHeaderMismatch is returned when an input's header doesn't match
+// the header already sent to clients.
+var ErrHeaderMismatch = errors.New("header mismatch")
+
+// A sourceInput is something a Source can read from: the primary
+// input given by -path or -exec, or one of the -fallback inputs.
+type sourceInput struct {
+	label    string // for log messages
+	path     string
+	execArgs []string
+	url      string // another http stream to relay
+	playlist string // media file or playlist to loop
+	shuffle  bool
+	exec     *execOptions
+}
+
+// stringsFlag is a flag.Value that collects the values of a flag
+// that can be given more than once.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(s string) error {
+	*sf = append(*sf, s)
+	return nil
+}
+
+// parseFallback returns the sourceInput described by a -fallback
+// value: "exec:" followed by a shell command, "playlist:" followed by
+// a media file or playlist, an http:// or https:// URL, or a file
+// path.
+func parseFallback(spec string) sourceInput {
+	switch {
+	case strings.HasPrefix(spec, "playlist:"):
+		return sourceInput{label: spec, playlist: strings.TrimPrefix(spec, "playlist:")}
+	case strings.HasPrefix(spec, "exec:"):
+		return sourceInput{
+			label:    spec,
+			execArgs: []string{"sh", "-c", strings.TrimPrefix(spec, "exec:")},
+		}
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return sourceInput{label: spec, url: spec}
+	default:
+		return sourceInput{label: spec, path: spec}
+	}
+}
+
+// open opens the input, or starts its child process. The returned
+// cmd is nil unless the input is a child process.
+func (in *sourceInput) open() (rc io.ReadCloser, cmd *exec.Cmd, err error) {
+	switch {
+	case len(in.execArgs) > 0:
+		cmd = in.exec.command(in.execArgs)
+		if rc, err = cmd.StdoutPipe(); err != nil {
+			return nil, nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+		return rc, cmd, nil
+	case in.playlist != "":
+		pr, err := newPlaylistReader(in.playlist, in.shuffle, in.label)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pr, nil, nil
+	case in.url != "":
+		resp, err := http.Get(in.url)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%s: %s", in.url, resp.Status)
+		}
+		return resp.Body, nil, nil
+	default:
+		f, err := os.Open(in.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, nil, nil
+	}
+}
+
+// openProbe is like open, but doesn't wait for a FIFO to have a
+// writer. A FIFO with no writer opens right away, and then reads EOF.
+func (in *sourceInput) openProbe() (rc io.ReadCloser, cmd *exec.Cmd, err error) {
+	if len(in.execArgs) > 0 || in.playlist != "" || in.url != "" {
+		return in.open()
+	}
+	f, err := os.OpenFile(in.path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// If the runtime poller can't wait for f to be readable
+	// (e.g., a FIFO on darwin), clear the nonblock flag, so reads
+	// wait for data instead of failing with EAGAIN.
+	if errors.Is(f.SetReadDeadline(time.Time{}), os.ErrNoDeadline) {
+		if conn, err := f.SyscallConn(); err == nil {
+			conn.Control(func(fd uintptr) {
+				syscall.SetNonblock(int(fd), false)
+			})
+		}
+	}
+	return f, nil, nil
+}
+
+// An openedInput is an input that was opened and checked by
+// probePrimary, ready for run() to switch to.
+type openedInput struct {
+	input io.ReadCloser
+	cmd   *exec.Cmd
+}
+
+// prefixReader returns data from prefix, then from the underlying
+// ReadCloser.
+type prefixReader struct {
+	io.Reader
+	io.Closer
+}
+
+// usingFallback returns true if the source is reading from one of
+// its -fallback inputs.
+func (s *Source) usingFallback() bool {
+	s.inputLock.Lock()
+	defer s.inputLock.Unlock()
+	return s.current > 0
+}
+
+// failover opens the next input that works, after the current one
+// fails: the following fallbacks in order, then (if the source can
+// be reopened) the primary input and the rest of the fallbacks. An
+// admin reopen tries the current input first.
+func (s *Source) failover() (err error) {
+	n := len(s.inputs)
+	start, tries := s.current+1, n-1-s.current
+	forced := s.reopenForced()
+	if forced {
+		start = s.current
+	}
+	if s.reopen || forced {
+		tries = n
+	}
+	return s.openFirst(start, tries)
+}
+
+// openFirst tries to open the given number of inputs, starting at
+// s.inputs[start] and wrapping around to the primary input, and
+// stops at the first one that works.
+func (s *Source) openFirst(start, tries int) (err error) {
+	err = ErrInputClosed
+	for i := 0; i < tries && !s.gone; i++ {
+		if err = s.openInput((start + i) % len(s.inputs)); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// probePrimary tries to open the primary input every
+// s.fallbackRetry, while the source is reading from a fallback. When
+// the primary input opens and supplies its header (or, without
+// -header-bytes, some data), probePrimary hands it to run(), which
+// switches back to it. A primary that opens but doesn't supply data
+// within s.fallbackRetry is closed, and probed again later.
+func (s *Source) probePrimary() {
+	defer func() {
+		s.inputLock.Lock()
+		s.probing = false
+		s.inputLock.Unlock()
+	}()
+	retry := s.fallbackRetry
+	if retry <= 0 {
+		retry = 5 * time.Second
+	}
+	for {
+		time.Sleep(retry)
+		if s.gone || !s.usingFallback() {
+			return
+		}
+		rc, cmd, err := s.inputs[0].openProbe()
+		if err != nil {
+			if Debugging {
+				log.Printf("source %s probe %s: %s", s.label, s.inputs[0].label, err)
+			}
+			continue
+		}
+		oi := &openedInput{input: rc, cmd: cmd}
+		if s.gone {
+			s.closeOpened(oi)
+			return
+		}
+		buf := make([]byte, s.HeaderBytes)
+		if s.HeaderBytes == 0 {
+			buf = make([]byte, s.frameBytes)
+		}
+		// Don't wait forever for a stalled input: closing rc
+		// interrupts the read.
+		timer := time.AfterFunc(retry, func() { rc.Close() })
+		var got int
+		if s.HeaderBytes > 0 {
+			got, err = io.ReadFull(rc, buf)
+		} else {
+			got, err = rc.Read(buf)
+		}
+		if !timer.Stop() {
+			err = fmt.Errorf("no data after %s", retry)
+		} else if err == nil && got == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if s.gone {
+			s.closeOpened(oi)
+			return
+		}
+		if err == nil && s.HeaderBytes > 0 {
+			if header, herr := s.getHeader(); herr != nil || !bytes.Equal(header, buf) {
+				err = ErrHeaderMismatch
+			}
+		}
+		if err != nil {
+			log.Printf("source %s probe %s: %v", s.label, s.inputs[0].label, err)
+			s.closeOpened(oi)
+			continue
+		}
+		if s.HeaderBytes == 0 {
+			oi.input = &prefixReader{io.MultiReader(bytes.NewReader(buf[:got]), rc), rc}
+		}
+		log.Printf("source %s primary input %s recovered", s.label, s.inputs[0].label)
+		s.inputLock.Lock()
+		s.recovered = oi
+		s.inputLock.Unlock()
+		// Interrupt the fallback, so run() notices.
+		s.closeInput()
+		return
+	}
+}
+
+// takeRecovered returns the primary input opened by probePrimary, if
+// any.
+func (s *Source) takeRecovered() *openedInput {
+	s.inputLock.Lock()
+	defer s.inputLock.Unlock()
+	oi := s.recovered
+	s.recovered = nil
+	return oi
+}
+
+// closeOpened closes an input opened by probePrimary.
+func (s *Source) closeOpened(oi *openedInput) {
+	oi.input.Close()
+	if oi.cmd != nil {
+		signalCmd(oi.cmd, syscall.SIGKILL)
+		oi.cmd.Wait()
+	}
+}
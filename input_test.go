@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseFallback(t *testing.T) {
+	for spec, expect := range map[string]sourceInput{
+		"/tmp/fifo":          {label: "/tmp/fifo", path: "/tmp/fifo"},
+		"exec:cat /dev/zero": {label: "exec:cat /dev/zero", execArgs: []string{"sh", "-c", "cat /dev/zero"}},
+		"http://relay/a.mp3": {label: "http://relay/a.mp3", url: "http://relay/a.mp3"},
+	} {
+		if got := parseFallback(spec); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: got %+v", spec, got)
+		}
+	}
+}
+
+// readFrameKinds reads 16-byte frames until it has seen the given
+// sequence of frame contents (each frame is 16 copies of one byte),
+// or the timeout expires.
+func readFrameKinds(t *testing.T, rdr *SourceReader, timeout time.Duration, expect ...byte) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 16)
+	var seen []byte
+	for len(expect) > 0 && time.Now().Before(deadline) {
+		n, err := rdr.Read(buf)
+		if err != nil {
+			t.Fatalf("after %q: %s", seen, err)
+		}
+		if n != 16 || !bytes.Equal(buf, bytes.Repeat(buf[:1], 16)) {
+			t.Fatalf("after %q: got mixed frame %q", seen, buf[:n])
+		}
+		if len(seen) == 0 || seen[len(seen)-1] != buf[0] {
+			seen = append(seen, buf[0])
+			if buf[0] == expect[0] {
+				expect = expect[1:]
+			}
+		}
+	}
+	if len(expect) > 0 {
+		t.Errorf("saw %q, still waiting for %q", seen, expect)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("primary", &Config{
+		Args:            []string{"sh", "-c", "printf HDR1; yes a | tr -d '\\n' | head -c 1600"},
+		ExecFlag:        true,
+		CloseIdle:       true,
+		FallbackRetry:   100 * time.Millisecond,
+		FrameBytes:      16,
+		HeaderBytes:     4,
+		SourceBandwidth: 160000,
+		SourceBuffer:    50,
+		Fallbacks: []string{
+			"exec:printf HDR2; yes c | tr -d '\\n'",
+			"exec:printf HDR1; yes b | tr -d '\\n'",
+		},
+	})
+	defer rdr.Close()
+	header := make([]byte, 4)
+	if _, err := rdr.Read(header); err != nil || string(header) != "HDR1" {
+		t.Fatalf("header %q, err %v", header, err)
+	}
+	// The first fallback has the wrong header, so it's skipped.
+	// The primary is restarted by probePrimary.
+	readFrameKinds(t, rdr, 5*time.Second, 'a', 'b', 'a')
+	if st := rdr.source.Status(); st.Input != "[sh -c printf HDR1; yes a | tr -d '\\n' | head -c 1600]" && st.Input != "exec:printf HDR1; yes b | tr -d '\\n'" {
+		t.Errorf("unexpected input %q", st.Input)
+	}
+	if n := atomic.LoadUint64(&rdr.source.statFailovers); n < 2 {
+		t.Errorf("expected >= 2 switches, got %d", n)
+	}
+}
+
+func TestFallbackHeaderMismatch(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("primary", &Config{
+		Args:         []string{"sh", "-c", "printf HDR1; yes a | tr -d '\\n' | head -c 160"},
+		ExecFlag:     true,
+		CloseIdle:    true,
+		FrameBytes:   16,
+		HeaderBytes:  4,
+		SourceBuffer: 50,
+		Fallbacks:    []string{"exec:printf HDR2; yes c | tr -d '\\n'"},
+	})
+	defer rdr.Close()
+	buf := make([]byte, 16)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := rdr.Read(buf); err != nil {
+			break
+		}
+	}
+	// The fallback was opened and rejected, so the source never
+	// switched to it.
+	if n := atomic.LoadUint64(&rdr.source.statFailovers); n != 0 {
+		t.Errorf("expected no switches, got %d", n)
+	}
+	if st := rdr.source.Status(); st.Fallback {
+		t.Errorf("status shows fallback %q", st.Input)
+	}
+}
+
+func TestFallbackNoReopen(t *testing.T) {
+	// Without fallbacks or -reopen, the source ends when the
+	// input does.
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("primary", &Config{
+		Args:         []string{"sh", "-c", "yes a | tr -d '\\n' | head -c 160"},
+		ExecFlag:     true,
+		CloseIdle:    true,
+		FrameBytes:   16,
+		SourceBuffer: 50,
+	})
+	defer rdr.Close()
+	buf := make([]byte, 16)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := rdr.Read(buf); err != nil {
+			return
+		}
+	}
+	t.Error("source did not end")
+}
+
+func TestProbeStalledPrimary(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// Supply the primary's header and a few frames, then
+		// leave the FIFO without a writer.
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		f.Write([]byte("HDR1" + strings.Repeat("a", 160)))
+		f.Close()
+	}()
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fifo, &Config{
+		Path:            fifo,
+		FallbackRetry:   50 * time.Millisecond,
+		FrameBytes:      16,
+		HeaderBytes:     4,
+		SourceBandwidth: 160000,
+		SourceBuffer:    50,
+		Fallbacks:       []string{"exec:printf HDR1; yes b | tr -d '\\n'"},
+	})
+	src := rdr.source
+	header := make([]byte, 4)
+	if _, err := rdr.Read(header); err != nil || string(header) != "HDR1" {
+		t.Fatalf("header %q, err %v", header, err)
+	}
+	readFrameKinds(t, rdr, 5*time.Second, 'b')
+
+	// A writer that never writes anything: probes should time
+	// out instead of waiting for the header.
+	w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	time.Sleep(200 * time.Millisecond)
+	if st := src.Status(); !st.Fallback {
+		t.Errorf("switched to stalled primary %q", st.Input)
+	}
+	rdr.Close()
+	src.Close()
+	probing := func() bool {
+		src.inputLock.Lock()
+		defer src.inputLock.Unlock()
+		return src.probing
+	}
+	deadline := time.Now().Add(time.Second)
+	for probing() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if probing() {
+		t.Error("probe still running after source closed")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// netList is a flag.Value holding a comma-separated list of IP
+// networks (CIDR notation) or single IP addresses.
+type netList []*net.IPNet
+
+func (nl *netList) String() string {
+	strs := make([]string, len(*nl))
+	for i, n := range *nl {
+		strs[i] = n.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (nl *netList) Set(s string) (err error) {
+	if s == "" {
+		*nl = nil
+		return nil
+	}
+	*nl, err = parseNetStrings(strings.Split(s, ","))
+	return
+}
+
+// contains returns true if ip is in one of the networks.
+func (nl netList) contains(ip net.IP) bool {
+	for _, n := range nl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientLimits end a client's response, at a frame boundary. They
+// are taken from the mount config, and can be overridden by a
+// token, a signed URL, or -auth-webhook. Zero means unlimited.
+type clientLimits struct {
+	maxBytes      uint64
+	maxDuration   time.Duration // wall clock time
+	maxStreamTime time.Duration // media time (see Durations)
+	expires       time.Time     // end of session (a signed URL's exp)
+}
+
+// override replaces the limits in cl with the non-zero limits in o.
+func (cl *clientLimits) override(o clientLimits) {
+	if o.maxBytes > 0 {
+		cl.maxBytes = o.maxBytes
+	}
+	if o.maxDuration > 0 {
+		cl.maxDuration = o.maxDuration
+	}
+	if o.maxStreamTime > 0 {
+		cl.maxStreamTime = o.maxStreamTime
+	}
+	if !o.expires.IsZero() {
+		cl.expires = o.expires
+	}
+}
+
+// restrict lowers the limits in cl to the non-zero limits in o, so a
+// webhook can't extend a limit set by a token or signed URL.
+func (cl *clientLimits) restrict(o clientLimits) {
+	if o.maxBytes > 0 && (cl.maxBytes == 0 || o.maxBytes < cl.maxBytes) {
+		cl.maxBytes = o.maxBytes
+	}
+	if o.maxDuration > 0 && (cl.maxDuration == 0 || o.maxDuration < cl.maxDuration) {
+		cl.maxDuration = o.maxDuration
+	}
+	if o.maxStreamTime > 0 && (cl.maxStreamTime == 0 || o.maxStreamTime < cl.maxStreamTime) {
+		cl.maxStreamTime = o.maxStreamTime
+	}
+	if !o.expires.IsZero() && (cl.expires.IsZero() || o.expires.Before(cl.expires)) {
+		cl.expires = o.expires
+	}
+}
+
+// apply sets sr's limits, for a client that started at startTime.
+// The session ends after maxDuration or at expires, whichever comes
+// first.
+func (cl clientLimits) apply(sr *SourceReader, startTime time.Time) {
+	sr.maxBytes = cl.maxBytes
+	sr.maxStreamTime = cl.maxStreamTime
+	sr.expires = cl.expires
+	if cl.maxDuration > 0 {
+		if end := startTime.Add(cl.maxDuration); sr.expires.IsZero() || end.Before(sr.expires) {
+			sr.expires = end
+		}
+	}
+}
+
+// A clientLimiter counts connected clients, and refuses new clients
+// that would exceed -max-clients, -max-clients-per-ip, or
+// -max-clients-per-stream.
+type clientLimiter struct {
+	total     int
+	perIP     map[string]int
+	perStream map[string]int
+	sync.Mutex
+}
+
+// A limitError explains why a client was refused.
+type limitError struct {
+	status int // HTTP response status
+	msg    string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// admit counts a new client at remoteAddr, reading the stream
+// configured by mc, or returns an error if that would exceed one of
+// the limits in c. If admit doesn't return an error, the caller must
+// call release() when the client disconnects. Clients in
+// c.LimitExempt are not limited or counted.
+func (l *clientLimiter) admit(c, mc *Config, remoteAddr string) (release func(), err error) {
+	ip := remoteIP(remoteAddr)
+	if ip != nil && netList(c.LimitExempt).contains(ip) {
+		return func() {}, nil
+	}
+	ipKey := remoteAddr
+	if ip != nil {
+		ipKey = ip.String()
+	}
+	stream := mc.SourceKey()
+	l.Lock()
+	defer l.Unlock()
+	if c.MaxClients > 0 && l.total >= c.MaxClients {
+		return nil, &limitError{http.StatusServiceUnavailable,
+			fmt.Sprintf("server is full (%d clients)", l.total)}
+	}
+	if mc.MaxClientsPerStream > 0 && l.perStream[stream] >= mc.MaxClientsPerStream {
+		return nil, &limitError{http.StatusServiceUnavailable,
+			fmt.Sprintf("stream is full (%d clients)", l.perStream[stream])}
+	}
+	if c.MaxClientsPerIP > 0 && l.perIP[ipKey] >= c.MaxClientsPerIP {
+		return nil, &limitError{http.StatusTooManyRequests,
+			fmt.Sprintf("too many connections from %s (%d clients)", ipKey, l.perIP[ipKey])}
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+		l.perStream = make(map[string]int)
+	}
+	l.total++
+	l.perIP[ipKey]++
+	l.perStream[stream]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			l.total--
+			if l.perIP[ipKey]--; l.perIP[ipKey] == 0 {
+				delete(l.perIP, ipKey)
+			}
+			if l.perStream[stream]--; l.perStream[stream] == 0 {
+				delete(l.perStream, stream)
+			}
+		})
+	}, nil
+}
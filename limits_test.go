@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	var l clientLimiter
+	c := &Config{MaxClients: 3, MaxClientsPerIP: 2}
+	a := &Config{Name: "/a", MaxClientsPerStream: 1}
+	b := &Config{Name: "/b"}
+	admit := func(mc *Config, addr string, status int) func() {
+		release, err := l.admit(c, mc, addr)
+		if status == 0 && err != nil {
+			t.Errorf("%s %s: unexpected error %s", mc.Name, addr, err)
+		} else if status != 0 && (err == nil || err.(*limitError).status != status) {
+			t.Errorf("%s %s: expected status %d, got %v", mc.Name, addr, status, err)
+		}
+		return release
+	}
+	ra := admit(a, "10.0.0.1:1", 0)
+	admit(a, "10.0.0.2:1", http.StatusServiceUnavailable)
+	rb := admit(b, "10.0.0.1:2", 0)
+	admit(b, "10.0.0.1:3", http.StatusTooManyRequests)
+	admit(b, "10.0.0.2:1", 0)
+	admit(b, "10.0.0.3:1", http.StatusServiceUnavailable)
+	ra()
+	ra()
+	admit(a, "10.0.0.3:1", 0)
+	rb()
+	admit(b, "10.0.0.1:3", 0)
+	admit(b, "10.0.0.4:1", http.StatusServiceUnavailable)
+
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	c.LimitExempt = []*net.IPNet{exempt}
+	admit(b, "10.0.0.1:4", 0)
+	admit(b, "10.0.0.1:5", 0)
+	admit(b, "192.168.0.1:1", http.StatusServiceUnavailable)
+}
+
+func TestNetListFlag(t *testing.T) {
+	var nl netList
+	if err := nl.Set("10.0.0.0/8,127.0.0.1,::1"); err != nil {
+		t.Fatal(err)
+	}
+	if s := nl.String(); s != "10.0.0.0/8,127.0.0.1/32,::1/128" {
+		t.Errorf("got %q", s)
+	}
+	if err := nl.Set("10.0.0.0/8,bogus"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestServerRefusesOverLimit(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		FrameBytes:      16,
+		LimitRetryAfter: 1500 * time.Millisecond,
+		MaxClientsPerIP: 1,
+		Path:            "/dev/zero",
+		Reopen:          true,
+		SourceBuffer:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first client got %s", resp.Status)
+	}
+	resp2, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second client got %s", resp2.Status)
+	}
+	if ra := resp2.Header.Get("Retry-After"); ra != "2" {
+		t.Errorf("Retry-After %q", ra)
+	}
+}
+
+func TestClientLimitsOverride(t *testing.T) {
+	cl := clientLimits{maxBytes: 1000, maxDuration: time.Hour}
+	cl.override(clientLimits{maxDuration: time.Minute, maxStreamTime: time.Second})
+	if cl != (clientLimits{maxBytes: 1000, maxDuration: time.Minute, maxStreamTime: time.Second}) {
+		t.Errorf("got %+v", cl)
+	}
+}
+
+func TestClientLimitsRestrict(t *testing.T) {
+	cl := clientLimits{maxBytes: 1000, maxDuration: time.Hour}
+	cl.restrict(clientLimits{maxBytes: 2000, maxDuration: time.Minute, maxStreamTime: time.Second})
+	if cl != (clientLimits{maxBytes: 1000, maxDuration: time.Minute, maxStreamTime: time.Second}) {
+		t.Errorf("got %+v", cl)
+	}
+}
+
+func TestClientMaxDuration(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:              ":0",
+		ClientMaxDuration: 200 * time.Millisecond,
+		FrameBytes:        16,
+		Path:              "/dev/zero",
+		Reopen:            true,
+		SourceBandwidth:   16000,
+		SourceBuffer:      4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	t0 := time.Now()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(t0); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("response ended after %s", elapsed)
+	}
+	if n%16 != 0 || n == 0 {
+		t.Errorf("got %d bytes, expected whole frames", n)
+	}
+}
+
+func TestClientMaxStreamTime(t *testing.T) {
+	// ~26ms per frame
+	fn := writeTestFile(t, bytes.Repeat(testMp3Frame(), 100))
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{FrameBytes: 2048, FrameFilter: "mp3", SourceBuffer: 200})
+	defer rdr.Close()
+	rdr.maxStreamTime = 100 * time.Millisecond
+	n, err := io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 4*417 {
+		t.Errorf("got %d bytes, expected 4 frames", n)
+	}
+}
+
+func TestCheckClientMaxStreamTime(t *testing.T) {
+	c := &Config{ClientMaxStreamTime: time.Minute, FrameBytes: 64, Path: "/dev/zero", SourceBuffer: 16}
+	if err := c.Check(); err == nil {
+		t.Error("expected error for raw filter")
+	}
+	c.FrameFilter = "mp3"
+	if err := c.Check(); err != nil {
+		t.Error(err)
+	}
+	c.FrameFilter = ""
+	c.RawByteRate = 176400
+	if err := c.Check(); err != nil {
+		t.Error(err)
+	}
+}
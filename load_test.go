@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A loadTest runs a server with many loopback clients, and measures
+// how well it keeps up.
+//
+// With Source "zero", the server reads /dev/zero at FrameRate frames
+// per second, and clients stop reading after Frames frames' worth of
+// time. With Source "mp3", the server reads a FIFO fed by a
+// generator that writes Frames MP3 frames, at FrameRate frames per
+// second, each stamped with a sequence number and the time it was
+// written; clients use these to measure skipped frames and delivery
+// latency. Latency is measured only by clients that read at full
+// speed. Slow clients stop reading when the source finishes.
+type loadTest struct {
+	Source      string // "zero" or "mp3"
+	Delivery    string // "goroutine" or "pool"
+	FrameRate   int    // source frames per second
+	Frames      int    // source frames to run for
+	Clients     int    // total number of clients
+	SlowClients int    // number of clients that read slowly
+	SlowRate    int    // bytes per second read by each slow client
+}
+
+type loadResult struct {
+	Elapsed    time.Duration
+	Bytes      uint64 // received by all clients
+	Skipped    uint64 // frames skipped by all clients
+	Latency    []time.Duration
+	Goroutines int   // most goroutines seen during the test
+	RSS        int64 // resident set size at the end of the test
+}
+
+// P99 returns the 99th percentile delivery latency, or 0 if latency
+// was not measured.
+func (r *loadResult) P99() time.Duration {
+	if len(r.Latency) == 0 {
+		return 0
+	}
+	sort.Slice(r.Latency, func(i, j int) bool { return r.Latency[i] < r.Latency[j] })
+	return r.Latency[len(r.Latency)*99/100]
+}
+
+// Report reports the results as benchmark metrics.
+func (r *loadResult) Report(b *testing.B, lt *loadTest) {
+	b.ReportMetric(float64(r.Bytes)/r.Elapsed.Seconds()/1e6, "MB/s")
+	b.ReportMetric(float64(r.Skipped)/float64(lt.Clients), "skipped/client")
+	if r.Latency != nil {
+		b.ReportMetric(float64(r.P99())/1e6, "p99-ms")
+	}
+	b.ReportMetric(float64(r.Goroutines), "goroutines")
+	b.ReportMetric(float64(r.RSS)/1e6, "rss-MB")
+}
+
+// synthetic MP3 frame: MPEG-1 layer III, 128 kbps, 44100 Hz, no
+// padding, no CRC.
+var loadMp3Header = []byte{0xff, 0xfb, 0x90, 0x64}
+
+const loadMp3FrameBytes = 417
+
+func (lt *loadTest) frameBytes() int {
+	if lt.Source == "mp3" {
+		return loadMp3FrameBytes
+	}
+	return 1 << 10
+}
+
+// Run runs the load test, and returns the results.
+func (lt *loadTest) Run(tb testing.TB) *loadResult {
+	frameBytes := lt.frameBytes()
+	duration := time.Duration(lt.Frames) * time.Second / time.Duration(lt.FrameRate)
+	c := &Config{
+		Addr:         ":0",
+		Delivery:     lt.Delivery,
+		FrameBytes:   uint64(frameBytes),
+		PoolWriters:  4,
+		SourceBuffer: 64,
+	}
+	var fifo string
+	if lt.Source == "mp3" {
+		fifo = filepath.Join(tb.TempDir(), "source.mp3")
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			tb.Fatal(err)
+		}
+		c.Path = fifo
+		c.FrameFilter = "mp3"
+		c.FrameBytes = 2048
+	} else {
+		c.Path = "/dev/zero"
+		c.Reopen = true
+		c.SourceBandwidth = uint64(frameBytes * lt.FrameRate)
+	}
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		tb.Fatal(err)
+	}
+	defer srv.Close()
+
+	res := &loadResult{}
+	var connected, finished sync.WaitGroup
+	var latencyLock sync.Mutex
+	connected.Add(lt.Clients)
+	finished.Add(lt.Clients)
+	deadline := time.Now().Add(duration + 10*time.Second)
+	start := make(chan struct{})
+	stop := make(chan struct{})
+	for i := 0; i < lt.Clients; i++ {
+		rate := 0
+		if i < lt.SlowClients {
+			rate = lt.SlowRate
+		}
+		go func() {
+			defer finished.Done()
+			cr, err := lt.client(srv.Addr, rate, deadline, &connected, start, stop)
+			if err != nil {
+				tb.Error(err)
+			}
+			atomic.AddUint64(&res.Bytes, cr.bytes)
+			atomic.AddUint64(&res.Skipped, cr.skipped)
+			latencyLock.Lock()
+			res.Latency = append(res.Latency, cr.latency...)
+			latencyLock.Unlock()
+		}()
+	}
+	connected.Wait()
+	// Wait for the server to attach all clients to the source
+	// before starting the clock.
+	for srv.sourceMap.clients() < lt.Clients && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	t0 := time.Now()
+	close(start)
+	if fifo != "" {
+		go func() {
+			lt.feed(tb, fifo)
+			close(stop)
+		}()
+	} else {
+		time.AfterFunc(duration, func() {
+			srv.sourceMap.Stop()
+			close(stop)
+		})
+	}
+	clientsDone := make(chan struct{})
+	go func() {
+		finished.Wait()
+		close(clientsDone)
+	}()
+	for running := true; running; {
+		if n := runtime.NumGoroutine(); n > res.Goroutines {
+			res.Goroutines = n
+		}
+		select {
+		case <-clientsDone:
+			running = false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	res.Elapsed = time.Since(t0)
+	res.RSS = rss()
+	if lt.Source != "mp3" {
+		// Clients can't see which frames they missed, so ask
+		// the sources.
+		res.Skipped = srv.sourceMap.skipped(deadline)
+	}
+	return res
+}
+
+type clientResult struct {
+	bytes   uint64
+	skipped uint64
+	latency []time.Duration
+}
+
+// client connects to the server, and reads frames until the server
+// disconnects or the deadline passes. If rate is not zero, it reads
+// at most rate bytes per second, and stops when stop is closed.
+func (lt *loadTest) client(addr string, rate int, deadline time.Time, connected *sync.WaitGroup, start, stop <-chan struct{}) (cr clientResult, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err == nil {
+		defer conn.Close()
+		conn.SetDeadline(deadline)
+		_, err = fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+	}
+	connected.Done()
+	if err != nil {
+		return
+	}
+	<-start
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, lt.frameBytes())
+	t0 := time.Now()
+	var lastSeq uint64
+	for frames := 0; ; frames++ {
+		if _, err = io.ReadFull(resp.Body, buf); err == io.EOF {
+			return cr, nil
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			return cr, nil
+		} else if err != nil {
+			return
+		}
+		cr.bytes += uint64(len(buf))
+		if lt.Source == "mp3" {
+			seq := binary.BigEndian.Uint64(buf[4:])
+			stamp := int64(binary.BigEndian.Uint64(buf[12:]))
+			if frames > 0 && seq > lastSeq+1 {
+				cr.skipped += seq - lastSeq - 1
+			}
+			lastSeq = seq
+			if rate == 0 {
+				cr.latency = append(cr.latency, time.Since(time.Unix(0, stamp)))
+			}
+		}
+		if rate > 0 {
+			select {
+			case <-stop:
+				return cr, nil
+			case <-time.After(time.Duration(cr.bytes)*time.Second/time.Duration(rate) - time.Since(t0)):
+			}
+		}
+	}
+}
+
+// feed writes lt.Frames frames to the given FIFO, then closes it.
+func (lt *loadTest) feed(tb testing.TB, fifo string) {
+	f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Error(err)
+		return
+	}
+	defer f.Close()
+	frame := make([]byte, loadMp3FrameBytes)
+	copy(frame, loadMp3Header)
+	for i := 20; i < len(frame); i++ {
+		frame[i] = 0x55
+	}
+	tick := time.NewTicker(time.Second / time.Duration(lt.FrameRate))
+	defer tick.Stop()
+	for seq := 0; seq < lt.Frames; seq++ {
+		<-tick.C
+		binary.BigEndian.PutUint64(frame[4:], uint64(seq))
+		binary.BigEndian.PutUint64(frame[12:], uint64(time.Now().UnixNano()))
+		if _, err := f.Write(frame); err != nil {
+			tb.Error(err)
+			return
+		}
+	}
+}
+
+// clients returns the number of clients attached to all sources.
+func (sm *SourceMap) clients() (n int) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, src := range sm.sources {
+		n += int(atomic.LoadUint64(&src.sinkCount))
+	}
+	return
+}
+
+// skipped waits (until deadline) for all clients to disconnect, and
+// returns the total number of frames they skipped.
+func (sm *SourceMap) skipped(deadline time.Time) (n uint64) {
+	for sm.clients() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, src := range sm.sources {
+		src.statClientSkipped.Lock()
+		n += uint64(src.statClientSkipped.sum)
+		src.statClientSkipped.Unlock()
+	}
+	return
+}
+
+// rss returns the resident set size of this process, or 0 if it
+// can't be determined.
+func rss() int64 {
+	buf, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	var size, resident int64
+	fmt.Sscan(string(buf), &size, &resident)
+	return resident * int64(os.Getpagesize())
+}
+
+func TestLoadHarness(t *testing.T) {
+	for _, source := range []string{"zero", "mp3"} {
+		for _, delivery := range []string{"goroutine", "pool"} {
+			lt := &loadTest{
+				Source:      source,
+				Delivery:    delivery,
+				FrameRate:   200,
+				Frames:      100,
+				Clients:     20,
+				SlowClients: 2,
+				SlowRate:    10000,
+			}
+			res := lt.Run(t)
+			t.Logf("%s/%s: %d bytes in %v, %d skipped, p99 %v, %d goroutines, %d rss", source, delivery, res.Bytes, res.Elapsed, res.Skipped, res.P99(), res.Goroutines, res.RSS)
+			if res.Bytes == 0 {
+				t.Errorf("%s/%s: clients received nothing", source, delivery)
+			}
+			if source == "mp3" && len(res.Latency) == 0 {
+				t.Errorf("%s/%s: no latency measurements", source, delivery)
+			}
+		}
+	}
+}
+
+func benchmarkLoad(b *testing.B, lt loadTest) {
+	lt.Frames = b.N
+	lt.Run(b).Report(b, &lt)
+}
+
+func BenchmarkLoadZero1000Clients(b *testing.B) {
+	benchmarkLoad(b, loadTest{Source: "zero", Delivery: "goroutine", FrameRate: 250, Clients: 1000, SlowClients: 50, SlowRate: 50000})
+}
+
+func BenchmarkLoadZero1000ClientsPool(b *testing.B) {
+	benchmarkLoad(b, loadTest{Source: "zero", Delivery: "pool", FrameRate: 250, Clients: 1000, SlowClients: 50, SlowRate: 50000})
+}
+
+func BenchmarkLoadMp31000Clients(b *testing.B) {
+	benchmarkLoad(b, loadTest{Source: "mp3", Delivery: "goroutine", FrameRate: 500, Clients: 1000, SlowClients: 50, SlowRate: 50000})
+}
+
+func BenchmarkLoadMp31000ClientsPool(b *testing.B) {
+	benchmarkLoad(b, loadTest{Source: "mp3", Delivery: "pool", FrameRate: 500, Clients: 1000, SlowClients: 50, SlowRate: 50000})
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -14,64 +19,232 @@ import (
 var Debugging = false
 
 type Config struct {
-	Addr             string
-	Path             string
-	FrameBytes       uint64
-	FrameFilter      string
-	HeaderBytes      uint64
-	SourceBuffer     uint64
-	SourceBandwidth  uint64
-	ClientMaxBytes   uint64
-	CloseIdle        bool
-	ContentType      string
-	CPUMax           int
-	ExecFlag         bool
-	Reopen           bool
-	StatLogInterval  time.Duration
-	MaxQuietInterval time.Duration
-	UID              int
-	Args             []string
+	Addr                  string
+	Path                  string
+	FrameBytes            uint64
+	FrameFilter           string
+	HeaderBytes           uint64
+	SourceBuffer          uint64
+	SourceBandwidth       uint64
+	ClientMaxBytes        uint64
+	Fallbacks             []string
+	Filler                string
+	Playlist              string
+	Shuffle               bool
+	TagMetadata           bool
+	Mp3Sync               int
+	Mp3CRC                bool
+	RawByteRate           uint64
+	Realtime              bool
+	FallbackRetry         time.Duration
+	ClientMaxDuration     time.Duration
+	ClientMaxStreamTime   time.Duration
+	FlushBytes            uint64
+	FlushInterval         time.Duration
+	CloseIdle             bool
+	ContentType           string
+	CPUMax                int
+	ExecFlag              bool
+	ExecEnv               []string
+	ExecDir               string
+	ExecStderr            bool
+	ExecStderrRate        int
+	ExecPgroup            bool
+	ExecUser              string
+	ExecGroup             string
+	ExecRlimitCPU         time.Duration
+	ExecRlimitAS          uint64
+	ExecRlimitNofile      uint64
+	ExecNice              int
+	ExecIonice            string
+	Reopen                bool
+	StatLogInterval       time.Duration
+	ClientStatLogInterval time.Duration
+	MaxQuietInterval      time.Duration
+	MetricsPath           string
+	AdminPath             string
+	AdminTokenFile        string
+	UID                   int
+	Args                  []string
+	ConfigFile            string
+	ShutdownTimeout       time.Duration
+	ChildKillDelay        time.Duration
+	RestartDelay          time.Duration
+	RestartDelayMax       time.Duration
+	RestartFailCount      int
+	RestartFailWindow     time.Duration
+	Delivery              string
+	PoolWriters           int
+	SlowClientPolicy      string
+	SlowClientMaxSkips    uint64
+	SlowClientMaxLag      time.Duration
+	SlowClientQueue       uint64
+	MaxClients            int
+	MaxClientsPerIP       int
+	MaxClientsPerStream   int
+	LimitExempt           []*net.IPNet // clients not subject to MaxClients* limits
+	LimitRetryAfter       time.Duration
+	AuthKeyFile           string
+	RequireAuth           bool
+	AuthWebhook           string
+	AuthWebhookSocket     string
+	AuthWebhookTimeout    time.Duration
+	Mounts                map[string]*Config // from ConfigFile, by URI path
+	Name                  string             // mount name (URI path), or "" if not using ConfigFile
+	Allow                 []*net.IPNet       // client networks allowed (nil = all)
+	Deny                  []*net.IPNet       // client networks denied
 }
 
 var config Config
 
 func init() {
 	config = Config{}
-	c := &config
-	flag.StringVar(&c.Addr, "address", "0.0.0.0:80",
+	config.flags(flag.CommandLine)
+	flag.BoolVar(&Debugging, "debug", false,
+		"Print debug info.")
+}
+
+// flags defines command line flags for the fields of c on fs, and
+// sets the fields to their default values.
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "address", "0.0.0.0:80",
 		"Address to listen on: \"host:port\" where host and port can be names or numbers.")
-	flag.StringVar(&c.Path, "path", "/dev/stdin",
+	fs.StringVar(&c.Path, "path", "/dev/stdin",
 		"Path to a source fifo, or a directory containing source fifos mapped onto the URI namespace.")
-	flag.BoolVar(&c.ExecFlag, "exec", false,
+	fs.BoolVar(&c.ExecFlag, "exec", false,
 		"Execute a command (given after all flags) and read from its stdout.")
-	flag.Uint64Var(&c.FrameBytes, "frame-bytes", 64,
+	fs.Var((*stringsFlag)(&c.ExecEnv), "exec-env",
+		"Set an environment variable (NAME=VALUE) for -exec and \"exec:\" -fallback commands. Can be given more than once. Commands also get STREAMSERVE_SOURCE (the source label) and, for a mount in a -config file, STREAMSERVE_PATH (the mount's URI path).")
+	fs.StringVar(&c.ExecDir, "exec-dir", "",
+		"Working directory for -exec and \"exec:\" -fallback commands. Default is streamserve's own working directory.")
+	fs.BoolVar(&c.ExecStderr, "exec-stderr", false,
+		"Write the stderr of -exec and \"exec:\" -fallback commands to the log, prefixed with the source label. Otherwise, it is discarded.")
+	fs.IntVar(&c.ExecStderrRate, "exec-stderr-rate", 10,
+		"Maximum lines per second logged by -exec-stderr for each source. Extra lines are dropped, and counted in the log. 0=unlimited.")
+	fs.StringVar(&c.ExecUser, "exec-user", "",
+		"Run -exec and \"exec:\" -fallback commands as the given user (name or uid), with the user's groups. Streamserve must be running as root (don't use -uid).")
+	fs.StringVar(&c.ExecGroup, "exec-group", "",
+		"Run -exec and \"exec:\" -fallback commands with the given group (name or gid) instead of the -exec-user's primary group.")
+	fs.DurationVar(&c.ExecRlimitCPU, "exec-rlimit-cpu", 0,
+		"Limit the CPU time used by each -exec child process (RLIMIT_CPU, rounded up to whole seconds). 0=unlimited. Linux only.")
+	fs.Uint64Var(&c.ExecRlimitAS, "exec-rlimit-as", 0,
+		"Limit the address space (virtual memory) of each -exec child process to this many bytes (RLIMIT_AS). 0=unlimited. Linux only.")
+	fs.Uint64Var(&c.ExecRlimitNofile, "exec-rlimit-nofile", 0,
+		"Limit the number of files each -exec child process can open (RLIMIT_NOFILE). 0=unlimited. Linux only.")
+	fs.IntVar(&c.ExecNice, "exec-nice", 0,
+		"Run -exec child processes at this nice level (-20 to 19; negative values need root). Linux only.")
+	fs.StringVar(&c.ExecIonice, "exec-ionice", "",
+		"Run -exec child processes with this I/O scheduling class: \"idle\", \"best-effort\", or \"realtime\", optionally followed by \":\" and a priority level from 0 (highest) to 7, e.g., \"best-effort:7\". Linux only.")
+	fs.BoolVar(&c.ExecPgroup, "exec-pgroup", false,
+		"Run -exec and \"exec:\" -fallback commands in their own process group, and send signals to the whole group when stopping them, so a pipeline like \"sh -c 'curl ... | lame ...'\" doesn't leave processes behind.")
+	fs.Uint64Var(&c.FrameBytes, "frame-bytes", 64,
 		"Size of a data frame. Only complete frames are sent to clients.")
-	flag.StringVar(&c.FrameFilter, "frame-filter", "",
+	fs.StringVar(&c.FrameFilter, "frame-filter", "",
 		"Detect frame boundaries in source streams and send only full frames to clients. When -frame-filter is active, -frame-bytes is the maximum frame size. Supported filter: mp3")
-	flag.Uint64Var(&c.HeaderBytes, "header-bytes", 0,
+	fs.Uint64Var(&c.HeaderBytes, "header-bytes", 0,
 		"Size of header. A header is read from each source when it is opened, and delivered to each client before sending any data bytes.")
-	flag.Uint64Var(&c.SourceBuffer, "source-buffer", 64,
+	fs.Uint64Var(&c.SourceBuffer, "source-buffer", 64,
 		"Number of frames to keep in memory for each source. The smaller this buffer is, the sooner a slow client will miss frames.")
-	flag.Uint64Var(&c.SourceBandwidth, "source-bandwidth", 0,
+	fs.Uint64Var(&c.SourceBandwidth, "source-bandwidth", 0,
 		"Maximum bandwidth for each source, in bytes per second. 0=unlimited.")
-	flag.Uint64Var(&c.ClientMaxBytes, "client-max-bytes", 0,
+	fs.Var((*stringsFlag)(&c.Fallbacks), "fallback",
+		"Input to read when the source input fails: a fifo or file path, an http:// or https:// URL, or \"exec:\" followed by a shell command. Can be given more than once; fallbacks are tried in order.")
+	fs.DurationVar(&c.FallbackRetry, "fallback-retry", 5*time.Second,
+		"While reading from a -fallback input, try to reopen the source input this often, and switch back when it works.")
+	fs.Uint64Var(&c.RawByteRate, "raw-byte-rate", 0,
+		"Bytes per second of media time, for raw PCM streams (sample rate * channels * bytes per sample; e.g., 176400 for CD audio). Gives frame durations for -realtime, -client-max-stream-time, and -filler. 0=unknown.")
+	fs.BoolVar(&c.Realtime, "realtime", false,
+		"Read the input no faster than real time, according to the frames' media durations (see -raw-byte-rate). Useful for serving a file as a live stream.")
+	fs.StringVar(&c.Playlist, "playlist", "",
+		"Instead of -path or -exec, read the given media file, or the files listed in the given M3U or plain text (.m3u, .m3u8, .txt) playlist, over and over, in real time (see -realtime). ID3 and APE tags are skipped. The playlist is reread when it changes.")
+	fs.BoolVar(&c.Shuffle, "shuffle", false,
+		"Play -playlist files in random order, reshuffling each time through the list.")
+	fs.IntVar(&c.Mp3Sync, "mp3-sync", 0,
+		"With -frame-filter mp3, after a glitch, accept a frame only if this many following frame headers agree on MPEG version, layer, and sample rate. -frame-bytes should be big enough to hold that many frames. 0=accept any valid header.")
+	fs.BoolVar(&c.Mp3CRC, "mp3-crc", false,
+		"With -frame-filter mp3, reject layer III frames with a CRC that doesn't match.")
+	fs.BoolVar(&c.TagMetadata, "tag-metadata", false,
+		"Log the title and artist found in ID3 tags in the input (see -frame-filter mp3), and show them in the admin source list.")
+	fs.StringVar(&c.Filler, "filler", "",
+		"While the source input is reopening, send clients \"silence\", or frames from the given file (repeated), at the stream's real-time rate. Needs -frame-filter mp3, -raw-byte-rate, or -source-bandwidth.")
+	fs.Uint64Var(&c.ClientMaxBytes, "client-max-bytes", 0,
 		"Maximum bytes to send to each client. 0=unlimited.")
-	flag.BoolVar(&c.CloseIdle, "close-idle", false,
+	fs.DurationVar(&c.ClientMaxDuration, "client-max-duration", 0,
+		"Disconnect each client after this much time (at a frame boundary). 0=unlimited.")
+	fs.DurationVar(&c.ClientMaxStreamTime, "client-max-stream-time", 0,
+		"Disconnect each client after sending this much media time, according to -frame-filter's frame durations. 0=unlimited.")
+	fs.Uint64Var(&c.FlushBytes, "flush-bytes", 65536,
+		"When a client is lagging behind the source, send data to the client after this many bytes accumulate in the output buffer. Clients that have caught up are sent each frame right away. 0=send every frame right away.")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", 100*time.Millisecond,
+		"When a client is lagging behind the source, send data to the client when it has been waiting in the output buffer this long.")
+	fs.BoolVar(&c.CloseIdle, "close-idle", false,
 		"Close an input FIFO if all of its clients disconnect. This stops whatever process is writing to the FIFO, which can be useful if that process consumes resources, but depends on that process to restart/resume reliably. The FIFO will reopen next time a client requests it.")
-	flag.StringVar(&c.ContentType, "content-type", "application/octet-stream",
+	fs.StringVar(&c.ContentType, "content-type", "application/octet-stream",
 		"Content-Type header for HTTP responses.")
-	flag.IntVar(&c.CPUMax, "cpu-max", runtime.NumCPU(),
+	fs.IntVar(&c.CPUMax, "cpu-max", runtime.NumCPU(),
 		"Maximum OS procs/threads to use. This effectively limits CPU consumption to the given number of cores. The default is the number of CPUs reported by the system. If 0 is given, the default is used.")
-	flag.BoolVar(&c.Reopen, "reopen", true,
+	fs.BoolVar(&c.Reopen, "reopen", true,
 		"Reopen and resume reading if an error is encountered while reading an input FIFO. Default is true. Use -reopen=false to disable.")
-	flag.DurationVar(&c.StatLogInterval, "stat-log-interval", 0,
+	fs.DurationVar(&c.RestartDelay, "restart-delay", 100*time.Millisecond,
+		"Wait this long before reopening a source input. The delay doubles (with random jitter) after each consecutive failure, up to -restart-delay-max.")
+	fs.DurationVar(&c.RestartDelayMax, "restart-delay-max", 30*time.Second,
+		"Maximum delay between attempts to reopen a source input.")
+	fs.IntVar(&c.RestartFailCount, "restart-fail-count", 0,
+		"After this many consecutive failures (the input can't be opened, or closes before supplying a frame) within -restart-fail-window, mark the source as failed, and refuse new clients (503) until it supplies a frame again. The systemd watchdog only detects failed sources if this is set. 0=never.")
+	fs.DurationVar(&c.RestartFailWindow, "restart-fail-window", time.Minute,
+		"See -restart-fail-count.")
+	fs.DurationVar(&c.StatLogInterval, "stat-log-interval", 0,
 		"Time between periodic statistics logs for each stream source, or 0 to disable.")
-	flag.DurationVar(&c.MaxQuietInterval, "max-quiet-interval", 0,
+	fs.DurationVar(&c.ClientStatLogInterval, "client-stats-log-interval", 0,
+		"Time between periodic statistics logs for each connected client, or 0 to disable.")
+	fs.DurationVar(&c.MaxQuietInterval, "max-quiet-interval", 0,
 		"Maximum time to wait for the next source frame before killing/closing/reopening the source, or 0 for unlimited.")
-	flag.IntVar(&c.UID, "uid", os.Getuid(),
+	fs.StringVar(&c.MetricsPath, "metrics-path", "/metrics",
+		"URI path where Prometheus metrics are served, or \"\" to disable.")
+	fs.StringVar(&c.AdminPath, "admin-path", "",
+		"URI path prefix where the admin API is served (e.g., \"/admin\"), or \"\" to disable.")
+	fs.StringVar(&c.AdminTokenFile, "admin-token-file", "",
+		"File containing the bearer token required by the admin API.")
+	fs.StringVar(&c.ConfigFile, "config", "",
+		"Read stream mount definitions from the given JSON file. Each mount has its own source and settings. Settings not given in the file are taken from the command line.")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"When shutting down (SIGTERM or SIGINT), maximum time to wait for clients to receive their current frames before closing their connections.")
+	fs.DurationVar(&c.ChildKillDelay, "child-kill-delay", 2*time.Second,
+		"Time to wait for a child process to exit after SIGTERM before sending SIGKILL, or 0 to send SIGKILL right away.")
+	fs.StringVar(&c.Delivery, "delivery", "goroutine",
+		"How to send data to clients: \"goroutine\" (one goroutine per client) or \"pool\" (a few writer goroutines per source, using non-blocking writes; uses less memory with very large numbers of clients).")
+	fs.IntVar(&c.PoolWriters, "pool-writers", 4,
+		"Number of writer goroutines for each source, when using -delivery=pool.")
+	fs.StringVar(&c.SlowClientPolicy, "slow-client-policy", "skip",
+		"What to do when a client falls behind the source: \"skip\" frames to catch up; \"disconnect-after-skips\" when more than -slow-client-max-skips frames have been skipped; \"disconnect-on-lag\" when the client is more than -slow-client-max-lag behind, or would have to skip frames; or \"queue\" up to -slow-client-queue frames for the client, and disconnect it if that isn't enough.")
+	fs.Uint64Var(&c.SlowClientMaxSkips, "slow-client-max-skips", 0,
+		"Frames a client can skip before being disconnected, with -slow-client-policy=disconnect-after-skips.")
+	fs.DurationVar(&c.SlowClientMaxLag, "slow-client-max-lag", 5*time.Second,
+		"How far a client can fall behind the source before being disconnected, with -slow-client-policy=disconnect-on-lag.")
+	fs.Uint64Var(&c.SlowClientQueue, "slow-client-queue", 256,
+		"Frames to keep for each client after they leave the source buffer, with -slow-client-policy=queue.")
+	fs.IntVar(&c.MaxClients, "max-clients", 0,
+		"Maximum number of clients connected to the server, or 0 for unlimited. Additional clients get 503.")
+	fs.IntVar(&c.MaxClientsPerIP, "max-clients-per-ip", 0,
+		"Maximum number of clients connected from a single IP address, or 0 for unlimited. Additional clients get 429.")
+	fs.IntVar(&c.MaxClientsPerStream, "max-clients-per-stream", 0,
+		"Maximum number of clients connected to each stream, or 0 for unlimited. Additional clients get 503.")
+	fs.Var((*netList)(&c.LimitExempt), "limit-exempt",
+		"Comma-separated list of IP networks (e.g., \"10.0.0.0/8,127.0.0.1\") whose clients are exempt from -max-clients, -max-clients-per-ip, and -max-clients-per-stream, and are not counted toward them.")
+	fs.DurationVar(&c.LimitRetryAfter, "limit-retry-after", 30*time.Second,
+		"Retry-After time sent to clients refused by -max-clients, -max-clients-per-ip, or -max-clients-per-stream.")
+	fs.StringVar(&c.AuthKeyFile, "auth-key-file", "",
+		"JSON file with the secret for signed URLs, and bearer tokens, used by -require-auth. Reloaded on SIGHUP.")
+	fs.BoolVar(&c.RequireAuth, "require-auth", false,
+		"Require clients to give a bearer token or a signed URL (see -auth-key-file).")
+	fs.StringVar(&c.AuthWebhook, "auth-webhook", "",
+		"URL to POST each client's details to before starting it (the reply can refuse or limit the client), and its stats to after it disconnects.")
+	fs.StringVar(&c.AuthWebhookSocket, "auth-webhook-socket", "",
+		"Connect to -auth-webhook through this unix socket instead of the host given in the URL.")
+	fs.DurationVar(&c.AuthWebhookTimeout, "auth-webhook-timeout", 5*time.Second,
+		"Refuse a client (503) if -auth-webhook doesn't reply within this time.")
+	fs.IntVar(&c.UID, "uid", os.Getuid(),
 		"Setuid() to the given user after binding the listening port. (Ignored if 0. In Linux, use setcap instead.)")
-	flag.BoolVar(&Debugging, "debug", false,
-		"Print debug info.")
 }
 
 // Check returns a non-nil error if the Config is unusable.
@@ -94,9 +267,36 @@ func (c Config) Check() error {
 	if c.ExecFlag && c.Path != flag.Lookup("path").DefValue && c.Path != "" {
 		return errors.New("cannot combine -exec and -path")
 	}
-	if c.ExecFlag == (len(c.Args) == 0) {
+	if c.ExecFlag == (len(c.Args) == 0) && c.Mounts == nil {
 		return errors.New("cannot use -exec without providing a command (or vice versa)")
 	}
+	if c.AdminPath != "" && c.AdminTokenFile == "" {
+		return errors.New("cannot use -admin-path without -admin-token-file")
+	}
+	if c.Delivery != "" && c.Delivery != "goroutine" && c.Delivery != "pool" {
+		return fmt.Errorf("-delivery \"%s\" not supported; try \"goroutine\" or \"pool\"", c.Delivery)
+	}
+	if c.FallbackRetry < 0 {
+		return errors.New("-fallback-retry must not be negative")
+	}
+	if c.PoolWriters < 0 {
+		return errors.New("-pool-writers must not be negative")
+	}
+	if c.RequireAuth && c.AuthKeyFile == "" {
+		return errors.New("cannot use -require-auth without -auth-key-file")
+	}
+	if c.MaxClients < 0 || c.MaxClientsPerIP < 0 || c.MaxClientsPerStream < 0 {
+		return errors.New("-max-clients, -max-clients-per-ip, and -max-clients-per-stream must not be negative")
+	}
+	if c.SlowClientPolicy != "" {
+		ok := false
+		for _, p := range slowClientPolicies {
+			ok = ok || p == c.SlowClientPolicy
+		}
+		if !ok {
+			return fmt.Errorf("-slow-client-policy \"%s\" not supported; try one of %q", c.SlowClientPolicy, slowClientPolicies)
+		}
+	}
 	if _, ok := Filters[c.FrameFilter]; !ok {
 		haveFilters := []string{}
 		for f := range Filters {
@@ -104,12 +304,71 @@ func (c Config) Check() error {
 		}
 		return fmt.Errorf("-frame-filter \"%s\" not supported; try one of %v", c.FrameFilter, haveFilters)
 	}
+	if (c.Mp3Sync != 0 || c.Mp3CRC) && c.FrameFilter != "mp3" {
+		return errors.New("-mp3-sync and -mp3-crc need -frame-filter mp3")
+	}
+	if c.Mp3Sync < 0 {
+		return errors.New("-mp3-sync must not be negative")
+	}
+	if c.Filler != "" && c.durationFunc() == nil && c.SourceBandwidth == 0 {
+		return fmt.Errorf("cannot use -filler with -frame-filter \"%s\" unless -raw-byte-rate or -source-bandwidth is given", c.FrameFilter)
+	}
+	if c.Filler == "silence" && Silences[c.FrameFilter] == nil {
+		return fmt.Errorf("-frame-filter \"%s\" does not support -filler silence", c.FrameFilter)
+	}
+	if c.ClientMaxStreamTime > 0 && c.durationFunc() == nil {
+		return fmt.Errorf("cannot use -client-max-stream-time with -frame-filter \"%s\" unless -raw-byte-rate is given", c.FrameFilter)
+	}
+	if c.Realtime && c.durationFunc() == nil {
+		return fmt.Errorf("cannot use -realtime with -frame-filter \"%s\" unless -raw-byte-rate is given", c.FrameFilter)
+	}
+	for _, env := range c.ExecEnv {
+		if i := strings.Index(env, "="); i < 1 {
+			return fmt.Errorf("-exec-env %q: must be NAME=VALUE", env)
+		}
+	}
+	if c.RestartDelay < 0 || c.RestartDelayMax < c.RestartDelay {
+		return errors.New("-restart-delay must not be negative, or more than -restart-delay-max")
+	}
+	if c.RestartFailCount < 0 {
+		return errors.New("-restart-fail-count must not be negative")
+	}
+	if _, err := c.childCredential(); err != nil {
+		return err
+	}
+	if cl, err := c.childLimits(); err != nil {
+		return fmt.Errorf("-exec-ionice: %s", err)
+	} else if err := checkChildLimits(cl); err != nil {
+		return err
+	}
+	if c.ExecNice < -20 || c.ExecNice > 19 {
+		return errors.New("-exec-nice must be between -20 and 19")
+	}
+	if c.ExecStderrRate < 0 {
+		return errors.New("-exec-stderr-rate must not be negative")
+	}
+	if c.Playlist != "" && c.ExecFlag {
+		return errors.New("cannot use both -playlist and -exec")
+	}
+	hasPlaylist := c.Playlist != ""
+	for _, fb := range c.Fallbacks {
+		hasPlaylist = hasPlaylist || strings.HasPrefix(fb, "playlist:")
+	}
+	if hasPlaylist && c.durationFunc() == nil {
+		return fmt.Errorf("cannot use a playlist with -frame-filter \"%s\" unless -raw-byte-rate is given", c.FrameFilter)
+	}
+	if c.Realtime && c.SourceBandwidth > 0 {
+		return errors.New("cannot use both -realtime and -source-bandwidth")
+	}
 	return nil
 }
 
 func main() {
 	flag.Parse()
 	config.Args = flag.Args()
+	if err := config.LoadConfigFile(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
 	if err := config.Check(); err != nil {
 		log.Fatalf("Invalid configuration: %s", err)
 	}
@@ -118,6 +377,27 @@ func main() {
 		log.Fatal(err)
 	}
 	log.Printf("Listening at %s", srv.Addr)
+	if config.ConfigFile != "" || config.AuthKeyFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Print("SIGHUP: reloading")
+				if err := srv.Reload(); err != nil {
+					log.Printf("reload failed: %s", err)
+				}
+			}
+		}()
+	}
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-term
+		log.Printf("%s: shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
 	if err := srv.Wait(); err != nil {
 		log.Fatal(err)
 	}
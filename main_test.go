@@ -1,9 +1,29 @@
 package main
 
 import (
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 )
 
+// testMp3Frame returns an MP3 frame (MPEG-1 layer III, 128 kbps,
+// 44100 Hz, no padding, no CRC): 417 bytes, 1152 samples (~26ms).
+func testMp3Frame() []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x64})
+	return frame
+}
+
+// writeTestFile writes data to a file in a temporary directory that
+// is removed when the test finishes, and returns the file name.
+func writeTestFile(t *testing.T, data []byte) string {
+	fn := filepath.Join(t.TempDir(), "testfile")
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
 func TestConfigCheck(t *testing.T) {
 	ok := Config{
 		SourceBuffer: 3,
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histogram accumulates observations in cumulative buckets, the way
+// Prometheus histograms expect them.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] is #observations <= bounds[i]
+	count  uint64
+	sum    float64
+	sync.Mutex
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// add adds o's observations to h. o must have the same bounds.
+func (h *histogram) add(o *histogram) {
+	o.Lock()
+	defer o.Unlock()
+	h.Lock()
+	defer h.Unlock()
+	for i := range h.counts {
+		h.counts[i] += o.counts[i]
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// writeTo writes the histogram's buckets, sum, and count in the
+// Prometheus text exposition format.
+func (h *histogram) writeTo(w io.Writer, name, labels string) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricDesc struct {
+	name  string
+	kind  string
+	help  string
+	value func(s *Source) uint64
+	hist  func(s *Source) *histogram
+	// For histograms, returns an empty histogram with the same
+	// bounds as hist
+	newHist func() *histogram
+}
+
+var sourceMetrics = []metricDesc{
+	{name: "streamserve_source_bytes_in_total", kind: "counter",
+		help:  "Bytes read from the source input.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statBytesIn) }},
+	{name: "streamserve_source_bytes_out_total", kind: "counter",
+		help:  "Bytes delivered to clients.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statBytesOut) }},
+	{name: "streamserve_source_bytes_invalid_total", kind: "counter",
+		help:  "Bytes rejected by the frame filter.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statBytesInvalid) }},
+	{name: "streamserve_source_bytes_tags_total", kind: "counter",
+		help:  "Bytes of ID3 and APE tags skipped by the frame filter.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statBytesTags) }},
+	{name: "streamserve_source_frames_rejected_total", kind: "counter",
+		help:  "Frames with valid headers rejected by the frame filter (see -mp3-sync and -mp3-crc).",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statFramesRejected) }},
+	{name: "streamserve_source_clients", kind: "gauge",
+		help:  "Clients currently reading from the source.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.sinkCount) }},
+	{name: "streamserve_source_frames_total", kind: "counter",
+		help:  "Frames produced by the source.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.nextFrame) }},
+	{name: "streamserve_source_reopens_total", kind: "counter",
+		help:  "Times the source input was reopened after closing.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statReopens) }},
+	{name: "streamserve_source_kills_total", kind: "counter",
+		help:  "Child processes killed.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statKills) }},
+	{name: "streamserve_source_quiet_kills_total", kind: "counter",
+		help:  "Inputs closed because -max-quiet-interval elapsed without data.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statQuietKills) }},
+	{name: "streamserve_source_input_switches_total", kind: "counter",
+		help:  "Times the source switched to a -fallback input, or back to the primary input.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statFailovers) }},
+	{name: "streamserve_source_fallback", kind: "gauge",
+		help: "1 if the source is reading from a -fallback input, otherwise 0.",
+		value: func(s *Source) uint64 {
+			if s.usingFallback() {
+				return 1
+			}
+			return 0
+		}},
+	{name: "streamserve_source_restart_failures_total", kind: "counter",
+		help:  "Attempts to reopen the source input that failed, or inputs that closed soon after opening.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statRestartFailures) }},
+	{name: "streamserve_source_failed", kind: "gauge",
+		help: "1 if the source input keeps failing (see -restart-fail-count) and new clients are refused, otherwise 0.",
+		value: func(s *Source) uint64 {
+			if s.isFailed() {
+				return 1
+			}
+			return 0
+		}},
+	{name: "streamserve_source_filler_frames_total", kind: "counter",
+		help:  "Filler frames sent while the source input was reopening.",
+		value: func(s *Source) uint64 { return atomic.LoadUint64(&s.statFillerFrames) }},
+	{name: "streamserve_client_frames_skipped", kind: "histogram",
+		help:    "Frames skipped by each client during its session.",
+		hist:    func(s *Source) *histogram { return s.statClientSkipped },
+		newHist: newClientSkippedHistogram},
+	{name: "streamserve_client_session_seconds", kind: "histogram",
+		help:    "Duration of client sessions.",
+		hist:    func(s *Source) *histogram { return s.statClientSeconds },
+		newHist: newClientSecondsHistogram},
+}
+
+// sourceTotals holds the counters and histograms of closed sources
+// with the same label, so a source's counters don't go back to zero
+// when it closes and reopens (e.g., with -close-idle, or after a
+// config reload).
+type sourceTotals struct {
+	counters []uint64     // indexed like sourceMetrics
+	hists    []*histogram // indexed like sourceMetrics
+}
+
+func newSourceTotals() *sourceTotals {
+	st := &sourceTotals{
+		counters: make([]uint64, len(sourceMetrics)),
+		hists:    make([]*histogram, len(sourceMetrics)),
+	}
+	for i, m := range sourceMetrics {
+		if m.newHist != nil {
+			st.hists[i] = m.newHist()
+		}
+	}
+	return st
+}
+
+func (st *sourceTotals) clone() *sourceTotals {
+	c := newSourceTotals()
+	copy(c.counters, st.counters)
+	for i, h := range st.hists {
+		if h != nil {
+			c.hists[i].add(h)
+		}
+	}
+	return c
+}
+
+// add adds s's counters and histograms to st.
+func (st *sourceTotals) add(s *Source) {
+	for i, m := range sourceMetrics {
+		if m.hist != nil {
+			st.hists[i].add(m.hist(s))
+		} else if m.kind == "counter" {
+			st.counters[i] += m.value(s)
+		}
+	}
+}
+
+// retire adds s's counters to the totals for its label, when s is
+// removed from the map. The caller must hold sm.mutex.
+func (sm *SourceMap) retire(s *Source) {
+	st := sm.totals[s.label]
+	if st == nil {
+		st = newSourceTotals()
+		sm.totals[s.label] = st
+	}
+	st.add(s)
+}
+
+// WriteMetrics writes statistics for all open sources in the
+// Prometheus text exposition format. Counters and histograms include
+// closed sources with the same label.
+func (sm *SourceMap) WriteMetrics(w io.Writer) {
+	sm.mutex.RLock()
+	totals := make(map[string]*sourceTotals, len(sm.totals)+len(sm.sources))
+	for label, st := range sm.totals {
+		totals[label] = st.clone()
+	}
+	live := make(map[string]*Source, len(sm.sources))
+	for _, src := range sm.sources {
+		live[src.label] = src
+	}
+	sm.mutex.RUnlock()
+	for label, s := range live {
+		if totals[label] == nil {
+			totals[label] = newSourceTotals()
+		}
+		totals[label].add(s)
+	}
+	names := make([]string, 0, len(totals))
+	for label := range totals {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	for i, m := range sourceMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, label := range names {
+			labels := `source="` + labelEscaper.Replace(label) + `"`
+			if m.hist != nil {
+				totals[label].hists[i].writeTo(w, m.name, labels)
+			} else if m.kind == "counter" {
+				fmt.Fprintf(w, "%s{%s} %d\n", m.name, labels, totals[label].counters[i])
+			} else if s := live[label]; s != nil {
+				// Gauges only apply to open sources.
+				fmt.Fprintf(w, "%s{%s} %d\n", m.name, labels, m.value(s))
+			}
+		}
+	}
+}
+
+func newClientSkippedHistogram() *histogram {
+	return newHistogram(0, 1, 10, 100, 1000, 10000, 100000)
+}
+
+func newClientSecondsHistogram() *histogram {
+	return newHistogram(1, 10, 60, 600, 3600, 6*3600, 24*3600)
+}
+
+// observeClient records a finished client session in the source's
+// histograms.
+func (s *Source) observeClient(sr *SourceReader) {
+	s.statClientSkipped.Observe(float64(sr.FramesSkipped))
+	s.statClientSeconds.Observe(time.Since(sr.startTime).Seconds())
+}
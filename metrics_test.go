@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 10)
+	for _, v := range []float64{0, 1, 5, 50} {
+		h.Observe(v)
+	}
+	buf := &bytes.Buffer{}
+	h.writeTo(buf, "x", `source="s"`)
+	for _, want := range []string{
+		`x_bucket{source="s",le="1"} 2`,
+		`x_bucket{source="s",le="10"} 3`,
+		`x_bucket{source="s",le="+Inf"} 4`,
+		`x_sum{source="s"} 56`,
+		`x_count{source="s"} 4`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %q in %q", want, buf.String())
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:           ":0",
+		FrameBytes:     16,
+		ClientMaxBytes: 64,
+		Path:           "/dev/zero",
+		Reopen:         true,
+		SourceBuffer:   4,
+		MetricsPath:    "/metrics",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp, err = http.Get(fmt.Sprintf("http://%s/metrics", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE streamserve_source_bytes_in_total counter\n",
+		"# TYPE streamserve_client_session_seconds histogram\n",
+		`streamserve_source_clients{source="/dev/zero"} 0` + "\n",
+		`streamserve_client_frames_skipped_count{source="/dev/zero"} 1` + "\n",
+	} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("missing %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsAfterClose(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	c := &Config{
+		CloseIdle:      true,
+		ClientMaxBytes: 64,
+		FrameBytes:     16,
+		SourceBuffer:   4,
+	}
+	for i := 0; i < 2; i++ {
+		rdr := sm.NewReader("/dev/zero", c)
+		ioutil.ReadAll(rdr)
+		rdr.Close()
+		if n := sm.Count(); n != 0 {
+			t.Fatalf("source still open: %d", n)
+		}
+	}
+	buf := &bytes.Buffer{}
+	sm.WriteMetrics(buf)
+	for _, want := range []string{
+		`streamserve_source_bytes_out_total{source="/dev/zero"} 128` + "\n",
+		`streamserve_client_frames_skipped_count{source="/dev/zero"} 2` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in metrics:\n%s", want, buf)
+		}
+	}
+	// Gauges are only reported for open sources.
+	if strings.Contains(buf.String(), "streamserve_source_clients{") {
+		t.Errorf("closed source has a clients gauge:\n%s", buf)
+	}
+}
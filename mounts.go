@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigFile is the format of the file given by -config.
+//
+// Each mount is a JSON object whose keys are the names of
+// command line flags (without the leading "-"), with the
+// following exceptions:
+//
+// "exec" is an array giving a command and its arguments, instead of
+// a boolean.
+//
+// "allow" and "deny" are arrays of IP networks in CIDR notation
+// ("10.0.0.0/8") or single IP addresses. If "allow" is given, only
+// clients in the listed networks can connect. Clients in "deny"
+// networks cannot connect.
+//
+// Flags that apply to the whole process, like -address and
+// -cpu-max, cannot be given for individual mounts. Flags that are
+// not given for a mount take their values from the command line
+// (or their defaults), except the input: each mount must give
+// "path", "exec", or "playlist".
+type ConfigFile struct {
+	Mounts map[string]map[string]interface{} `json:"mounts"`
+}
+
+// Flags that can't be set per mount.
+var globalFlags = map[string]bool{
+	"address":              true,
+	"admin-path":           true,
+	"admin-token-file":     true,
+	"auth-key-file":        true,
+	"auth-webhook-socket":  true,
+	"auth-webhook-timeout": true,
+	"config":               true,
+	"cpu-max":              true,
+	"debug":                true,
+	"limit-exempt":         true,
+	"limit-retry-after":    true,
+	"max-clients":          true,
+	"max-clients-per-ip":   true,
+	"metrics-path":         true,
+	"shutdown-timeout":     true,
+	"uid":                  true,
+}
+
+// LoadConfigFile reads mount definitions from c.ConfigFile (if
+// given) into c.Mounts.
+func (c *Config) LoadConfigFile() error {
+	if c.ConfigFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.ConfigFile)
+	if err != nil {
+		return err
+	}
+	mounts, err := c.parseMounts(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.ConfigFile, err)
+	}
+	c.Mounts = mounts
+	return nil
+}
+
+// parseMounts returns the mounts defined in the given config file
+// content, using c's settings as defaults.
+func (c *Config) parseMounts(buf []byte) (map[string]*Config, error) {
+	var cf ConfigFile
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&cf); err != nil {
+		return nil, err
+	}
+	if len(cf.Mounts) == 0 {
+		return nil, errors.New("no mounts defined")
+	}
+	mounts := make(map[string]*Config)
+	for name, settings := range cf.Mounts {
+		if !strings.HasPrefix(name, "/") {
+			return nil, fmt.Errorf("mount %q: name must start with \"/\"", name)
+		}
+		mc, err := c.newMount(name, settings)
+		if err != nil {
+			return nil, fmt.Errorf("mount %q: %s", name, err)
+		}
+		mounts[name] = mc
+	}
+	return mounts, nil
+}
+
+func (c *Config) newMount(name string, settings map[string]interface{}) (*Config, error) {
+	mc := &Config{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	mc.flags(fs)
+	*mc = *c
+	mc.Name = name
+	mc.Mounts = nil
+	mc.ExecFlag = false
+	mc.Args = nil
+	mc.Path = fs.Lookup("path").DefValue
+	// Apply settings in a predictable order, so error messages
+	// are predictable too.
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		val := settings[key]
+		switch key {
+		case "exec":
+			args, err := stringList(val)
+			if err != nil || len(args) == 0 {
+				return nil, errors.New("\"exec\" must be a non-empty array of strings")
+			}
+			mc.ExecFlag = true
+			mc.Args = args
+		case "exec-env":
+			env, err := stringList(val)
+			if err != nil {
+				return nil, errors.New("\"exec-env\" must be an array of strings")
+			}
+			mc.ExecEnv = env
+		case "fallback":
+			fallbacks, err := stringList(val)
+			if err != nil {
+				return nil, errors.New("\"fallback\" must be an array of strings")
+			}
+			mc.Fallbacks = fallbacks
+		case "allow", "deny":
+			nets, err := parseNets(val)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %s", key, err)
+			}
+			if key == "allow" {
+				mc.Allow = nets
+			} else {
+				mc.Deny = nets
+			}
+		default:
+			if globalFlags[key] || fs.Lookup(key) == nil {
+				return nil, fmt.Errorf("%q cannot be set per mount", key)
+			}
+			var s string
+			switch val := val.(type) {
+			case string:
+				s = val
+			case bool, json.Number:
+				s = fmt.Sprint(val)
+			default:
+				return nil, fmt.Errorf("%q: unsupported value %v", key, val)
+			}
+			if err := fs.Set(key, s); err != nil {
+				return nil, fmt.Errorf("%q: %s", key, err)
+			}
+		}
+	}
+	if err := mc.Check(); err != nil {
+		return nil, err
+	}
+	if settings["path"] == nil && !mc.ExecFlag && mc.Playlist == "" {
+		return nil, errors.New("no input: give \"path\", \"exec\", or \"playlist\"")
+	}
+	return mc, nil
+}
+
+func stringList(val interface{}) ([]string, error) {
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+	strs := make([]string, len(list))
+	for i, v := range list {
+		if strs[i], ok = v.(string); !ok {
+			return nil, fmt.Errorf("%v is not a string", v)
+		}
+	}
+	return strs, nil
+}
+
+func parseNets(val interface{}) ([]*net.IPNet, error) {
+	strs, err := stringList(val)
+	if err != nil {
+		return nil, err
+	}
+	return parseNetStrings(strs)
+}
+
+// parseNetStrings parses IP networks in CIDR notation, or single IP
+// addresses.
+func parseNetStrings(strs []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, len(strs))
+	for i, s := range strs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			} else if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		if _, nets[i], err = net.ParseCIDR(s); err != nil {
+			return nil, err
+		}
+	}
+	return nets, nil
+}
+
+// Mount returns the configuration for the given request path, or nil
+// if nothing is mounted there. Without a config file, the top level
+// configuration is used for every path.
+func (c *Config) Mount(path string) *Config {
+	if c.Mounts == nil {
+		return c
+	}
+	return c.Mounts[path]
+}
+
+// SourceKey returns the SourceMap key for c's source.
+func (c *Config) SourceKey() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Path
+}
+
+// Permits returns true if the Allow and Deny rules permit clients at
+// the given remote address ("host:port") to connect.
+func (c *Config) Permits(remoteAddr string) bool {
+	if c.Allow == nil && c.Deny == nil {
+		return true
+	}
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if c.Allow == nil {
+		return true
+	}
+	for _, n := range c.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address part of a remote address
+// ("host:port"), or nil if it isn't an IP address.
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// needsNewSource returns true if changing a mount's config from a to
+// b can't be done without setting up a new ring buffer and reopening
+// the input.
+func needsNewSource(a, b *Config) bool {
+	return a.Path != b.Path ||
+		a.ExecFlag != b.ExecFlag ||
+		a.Playlist != b.Playlist ||
+		a.Shuffle != b.Shuffle ||
+		!reflect.DeepEqual(a.Args, b.Args) ||
+		!reflect.DeepEqual(a.Fallbacks, b.Fallbacks) ||
+		!reflect.DeepEqual(a.ExecEnv, b.ExecEnv) ||
+		a.ExecDir != b.ExecDir ||
+		a.ExecStderr != b.ExecStderr ||
+		a.ExecStderrRate != b.ExecStderrRate ||
+		a.ExecPgroup != b.ExecPgroup ||
+		a.ExecUser != b.ExecUser ||
+		a.ExecGroup != b.ExecGroup ||
+		a.ExecRlimitCPU != b.ExecRlimitCPU ||
+		a.ExecRlimitAS != b.ExecRlimitAS ||
+		a.ExecRlimitNofile != b.ExecRlimitNofile ||
+		a.ExecNice != b.ExecNice ||
+		a.ExecIonice != b.ExecIonice ||
+		a.FrameBytes != b.FrameBytes ||
+		a.FrameFilter != b.FrameFilter ||
+		a.Mp3Sync != b.Mp3Sync ||
+		a.Mp3CRC != b.Mp3CRC ||
+		a.RawByteRate != b.RawByteRate ||
+		a.HeaderBytes != b.HeaderBytes ||
+		a.SourceBuffer != b.SourceBuffer ||
+		a.StatLogInterval != b.StatLogInterval ||
+		a.ClientStatLogInterval != b.ClientStatLogInterval ||
+		a.MaxQuietInterval != b.MaxQuietInterval
+}
+
+// reconfigure applies settings from c that can be changed without
+// interrupting clients. Other changes are saved, and applied next
+// time the input is reopened.
+func (s *Source) reconfigure(c *Config, needNew bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.clientMaxBytes = c.ClientMaxBytes
+	s.bandwidth = c.SourceBandwidth
+	s.closeIdle = c.CloseIdle
+	s.reopen = c.Reopen
+	s.childKillDelay = c.ChildKillDelay
+	s.fallbackRetry = c.FallbackRetry
+	s.filler = c.Filler
+	s.realtime = c.Realtime
+	s.tagMetadata = c.TagMetadata
+	s.restart = c.restartPolicy()
+	s.setSlowPolicy(c)
+	if needNew {
+		s.pending = c
+	} else {
+		s.pending = nil
+	}
+}
+
+func (s *Source) pendingConfig() *Config {
+	s.RLock()
+	defer s.RUnlock()
+	return s.pending
+}
+
+// replace starts a new source with the given config, and arranges
+// for this source's readers to move to the new source when they have
+// read everything in this source's buffer.
+func (s *Source) replace(c *Config) {
+	sm := s.sourceMap
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.sources[s.key] != s {
+		return
+	}
+	log.Printf("source %s replaced with new config", s.label)
+	ns := NewSource(s.key, c, sm)
+	sm.sources[s.key] = ns
+	sm.retire(s)
+	s.Lock()
+	s.successor = ns
+	s.Unlock()
+	go ns.run()
+}
+
+// Remove closes the source with the given key (if it is open) and
+// removes it from the map. Its clients are disconnected after they
+// read the frames remaining in its buffer.
+func (sm *SourceMap) Remove(key string) {
+	sm.mutex.Lock()
+	src := sm.sources[key]
+	delete(sm.sources, key)
+	if src != nil {
+		sm.retire(src)
+	}
+	sm.mutex.Unlock()
+	if src != nil {
+		src.Close()
+	}
+}
+
+// mount returns the current configuration for the given request
+// path, or nil if nothing is mounted there.
+func (srv *Server) mount(path string) *Config {
+	srv.mountsLock.RLock()
+	defer srv.mountsLock.RUnlock()
+	if srv.mounts == nil {
+		return srv.config.Mount(path)
+	}
+	return srv.mounts[path]
+}
+
+// Reload rereads the config file, and updates the running
+// configuration to match: new mounts are added, removed mounts are
+// drained and closed, and changed mounts are reconfigured.
+func (srv *Server) Reload() error {
+	if srv.config.ConfigFile == "" && srv.config.AuthKeyFile == "" {
+		return errors.New("no config file to reload")
+	}
+	if srv.config.AuthKeyFile != "" {
+		if err := srv.loadAuthKeys(); err != nil {
+			return err
+		}
+	}
+	if srv.config.ConfigFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(srv.config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	mounts, err := srv.config.parseMounts(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %s", srv.config.ConfigFile, err)
+	}
+	srv.mountsLock.Lock()
+	old := srv.mounts
+	srv.mounts = mounts
+	srv.mountsLock.Unlock()
+
+	var added, removed, inPlace, deferred, unchanged int
+	for name, oc := range old {
+		if _, ok := mounts[name]; !ok {
+			log.Printf("reload: removing mount %s", name)
+			srv.sourceMap.Remove(oc.SourceKey())
+			removed++
+		}
+	}
+	for name, nc := range mounts {
+		oc, ok := old[name]
+		if !ok {
+			log.Printf("reload: adding mount %s", name)
+			added++
+			continue
+		} else if reflect.DeepEqual(oc, nc) {
+			unchanged++
+			continue
+		}
+		needNew := needsNewSource(oc, nc)
+		if needNew {
+			log.Printf("reload: mount %s changes will take effect when its source reopens", name)
+			deferred++
+		} else {
+			log.Printf("reload: mount %s changed", name)
+			inPlace++
+		}
+		if src := srv.sourceMap.Source(nc.SourceKey()); src != nil {
+			src.reconfigure(nc, needNew)
+		}
+	}
+	log.Printf("reload: %d added, %d removed, %d changed, %d changed at next reopen, %d unchanged", added, removed, inPlace, deferred, unchanged)
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMounts(t *testing.T) {
+	defaults := Config{
+		SourceBuffer: 64,
+		FrameBytes:   64,
+		ContentType:  "application/octet-stream",
+		Reopen:       true,
+	}
+	mounts, err := defaults.parseMounts([]byte(`{"mounts": {
+		"/a.mp3": {
+			"path": "/tmp/a.fifo",
+			"frame-filter": "mp3",
+			"frame-bytes": 2048,
+			"source-buffer": 1000000,
+			"content-type": "audio/mpeg",
+			"max-quiet-interval": "1m",
+			"allow": ["10.0.0.0/8", "127.0.0.1"]
+		},
+		"/b": {
+			"exec": ["sh", "-c", "cat /dev/urandom"],
+			"reopen": false,
+			"deny": ["192.168.0.0/16"]
+		}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := mounts["/a.mp3"], mounts["/b"]
+	if a == nil || b == nil {
+		t.Fatalf("missing mounts in %v", mounts)
+	}
+	if a.Path != "/tmp/a.fifo" || a.FrameFilter != "mp3" || a.FrameBytes != 2048 || a.SourceBuffer != 1000000 || a.ContentType != "audio/mpeg" || a.MaxQuietInterval != time.Minute {
+		t.Errorf("mount a: %+v", a)
+	}
+	if !b.ExecFlag || len(b.Args) != 3 || b.Reopen || b.FrameBytes != 64 || b.ContentType != "application/octet-stream" {
+		t.Errorf("mount b: %+v", b)
+	}
+	if a.SourceKey() != "/a.mp3" || b.SourceKey() != "/b" {
+		t.Errorf("source keys %q, %q", a.SourceKey(), b.SourceKey())
+	}
+	for addr, ok := range map[string]bool{
+		"10.1.2.3:1234":  true,
+		"127.0.0.1:1234": true,
+		"127.0.0.2:1234": false,
+		"[::1]:1234":     false,
+	} {
+		if a.Permits(addr) != ok {
+			t.Errorf("a.Permits(%q) should be %v", addr, ok)
+		}
+	}
+	if b.Permits("192.168.1.1:1") || !b.Permits("10.1.1.1:1") {
+		t.Error("mount b deny rules not applied")
+	}
+
+	for _, bad := range []string{
+		`{"mounts": {}}`,
+		`{"mounts": {"nope": {"path": "/dev/zero"}}}`,
+		`{"mounts": {"/x": {"address": ":80"}}}`,
+		`{"mounts": {"/x": {"no-such-flag": 1}}}`,
+		`{"mounts": {"/x": {"frame-bytes": "lots"}}}`,
+		`{"mounts": {"/x": {"exec": "cat"}}}`,
+		`{"mounts": {"/x": {"allow": ["10.0.0.300/8"]}}}`,
+		`{"mounts": {"/x": {"source-buffer": 1}}}`,
+		`{"mounts": {"/x": {"content-type": "audio/mpeg"}}}`,
+	} {
+		if _, err := defaults.parseMounts([]byte(bad)); err == nil {
+			t.Errorf("accepted bad config %s", bad)
+		} else {
+			t.Logf("rejected %s: %s", bad, err)
+		}
+	}
+}
+
+func TestServerMounts(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "streamserve.json")
+	err := ioutil.WriteFile(confFile, []byte(`{"mounts": {
+		"/zero": {"path": "/dev/zero", "content-type": "audio/x-zero", "frame-bytes": 8},
+		"/echo": {"exec": ["echo", "-n", "foo"], "frame-bytes": 3},
+		"/private": {"path": "/dev/zero", "allow": ["192.0.2.0/24"]}
+	}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		Addr:           ":0",
+		FrameBytes:     64,
+		SourceBuffer:   4,
+		ClientMaxBytes: 24,
+		Reopen:         true,
+		Path:           "/dev/stdin",
+		ContentType:    "application/octet-stream",
+		ConfigFile:     confFile,
+	}
+	if err := c.LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for path, want := range map[string]struct {
+		status      int
+		contentType string
+		body        string
+	}{
+		"/zero":    {200, "audio/x-zero", string(make([]byte, 24))},
+		"/echo":    {200, "application/octet-stream", "foofoofoofoofoofoofoofoo"},
+		"/private": {403, "", ""},
+		"/nothing": {404, "", ""},
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", srv.Addr, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want.status {
+			t.Errorf("%s: status %d, want %d", path, resp.StatusCode, want.status)
+		} else if want.status == 200 && (resp.Header.Get("Content-Type") != want.contentType || string(body) != want.body) {
+			t.Errorf("%s: got %q %q, want %q %q", path, resp.Header.Get("Content-Type"), body, want.contentType, want.body)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "streamserve.json")
+	writeConf := func(conf string) {
+		if err := ioutil.WriteFile(confFile, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConf(`{"mounts": {
+		"/a": {"path": "/dev/zero"},
+		"/b": {"path": "/dev/zero", "content-type": "audio/x-old"},
+		"/c": {"path": "/dev/zero", "frame-bytes": 8}
+	}}`)
+	c := &Config{
+		Addr:            ":0",
+		FrameBytes:      4,
+		SourceBuffer:    4,
+		SourceBandwidth: 4000,
+		Reopen:          true,
+		Path:            "/dev/stdin",
+		ContentType:     "application/octet-stream",
+		ConfigFile:      confFile,
+	}
+	if err := c.LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	get := func(path string) *http.Response {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", srv.Addr, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	respA := get("/a")
+	defer respA.Body.Close()
+	respC := get("/c")
+	defer respC.Body.Close()
+	if _, err := respC.Body.Read(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConf(`{"mounts": {
+		"/b": {"path": "/dev/zero", "content-type": "audio/x-new"},
+		"/c": {"path": "/dev/zero", "frame-bytes": 16},
+		"/d": {"path": "/dev/zero"}
+	}}`)
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		ioutil.ReadAll(respA.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("client of removed mount still connected after 1s")
+	}
+	if resp := get("/a"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("removed mount: status %d", resp.StatusCode)
+	}
+	if resp := get("/d"); resp.StatusCode != http.StatusOK {
+		t.Errorf("added mount: status %d", resp.StatusCode)
+	} else {
+		resp.Body.Close()
+	}
+	if resp := get("/b"); resp.Header.Get("Content-Type") != "audio/x-new" {
+		t.Errorf("changed mount: content type %q", resp.Header.Get("Content-Type"))
+	} else {
+		resp.Body.Close()
+	}
+
+	// /c needs a new ring buffer. When its source reopens, the
+	// connected client should carry on reading from the new
+	// source.
+	srcC := srv.sourceMap.Source("/c")
+	if srcC.pendingConfig() == nil || srcC.frameBytes != 8 {
+		t.Fatal("/c config change should be pending")
+	}
+	srcC.Reopen()
+	deadline := time.Now().Add(time.Second)
+	for srv.sourceMap.Source("/c") == srcC && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	newC := srv.sourceMap.Source("/c")
+	if newC == srcC || newC.frameBytes != 16 {
+		t.Fatal("/c source was not replaced")
+	}
+	if _, err := io.ReadFull(respC.Body, make([]byte, 256)); err != nil {
+		t.Errorf("/c client disconnected: %s", err)
+	}
+	if n := len(newC.Status().Clients); n != 1 {
+		t.Errorf("/c client did not move to new source: %d clients", n)
+	}
+}
+
+func TestReloadHeaderChange(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "streamserve.json")
+	writeConf := func(header string) {
+		conf := fmt.Sprintf(`{"mounts": {
+			"/h": {"exec": ["sh", "-c", "printf %s; exec cat /dev/zero"], "header-bytes": 4}
+		}}`, header)
+		if err := ioutil.WriteFile(confFile, []byte(conf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConf("HDR1")
+	c := &Config{
+		Addr:            ":0",
+		FrameBytes:      4,
+		SourceBuffer:    4,
+		SourceBandwidth: 4000,
+		Reopen:          true,
+		Path:            "/dev/stdin",
+		ContentType:     "application/octet-stream",
+		ConfigFile:      confFile,
+	}
+	if err := c.LoadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	get := func() *http.Response {
+		resp, err := http.Get(fmt.Sprintf("http://%s/h", srv.Addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := get()
+	defer resp.Body.Close()
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf[:4]) != "HDR1" {
+		t.Fatalf("got header %q", buf[:4])
+	}
+
+	writeConf("HDR2")
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	src := srv.sourceMap.Source("/h")
+	src.Reopen()
+
+	// The connected client has the old header, so it can't carry
+	// on reading from the new source.
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client still connected after header changed")
+	}
+	if newSrc := srv.sourceMap.Source("/h"); newSrc == src {
+		t.Fatal("source was not replaced")
+	}
+	resp2 := get()
+	defer resp2.Body.Close()
+	if _, err := io.ReadFull(resp2.Body, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf[:4]) != "HDR2" {
+		t.Errorf("new client got header %q", buf[:4])
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEmptyPlaylist is returned when none of the files in a playlist
+// can be read.
+var ErrEmptyPlaylist = errors.New("no playable files in playlist")
+
+// isPlaylist returns true if path looks like a playlist (M3U, or a
+// plain text list of files) rather than a media file.
+func isPlaylist(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8", ".txt":
+		return true
+	}
+	return false
+}
+
+// readPlaylist returns the files listed in an M3U or plain text
+// playlist, one per line. Blank lines and lines starting with "#"
+// are ignored. Relative paths are relative to the playlist's
+// directory.
+func readPlaylist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		files = append(files, line)
+	}
+	return files, scanner.Err()
+}
+
+// A playlistReader reads a media file, or each of the files in a
+// playlist, over and over, without any ID3 or APE tags. When it
+// finishes a file, it rereads the playlist if it has changed.
+type playlistReader struct {
+	path    string // media file or playlist
+	shuffle bool
+	label   string // for log messages
+
+	files   []string
+	modTime time.Time // of playlist, when files was read
+	next    int       // index in files of the next file to play
+	current string
+	file    *os.File
+	data    io.Reader // audio data in file
+	gotData bool      // read some data from file
+	failed  int       // files in a row that failed or had no data
+	closed  bool
+	sync.Mutex
+}
+
+func newPlaylistReader(path string, shuffle bool, label string) (*playlistReader, error) {
+	pr := &playlistReader{path: path, shuffle: shuffle, label: label}
+	if err := pr.reload(); err != nil {
+		return nil, err
+	}
+	if len(pr.files) == 0 {
+		return nil, ErrEmptyPlaylist
+	}
+	return pr, nil
+}
+
+// reload rereads the playlist if it has changed since it was last
+// read. Playback continues after the current file, if it is still
+// in the playlist, and otherwise from the start.
+func (pr *playlistReader) reload() error {
+	if !isPlaylist(pr.path) {
+		pr.files = []string{pr.path}
+		return nil
+	}
+	fi, err := os.Stat(pr.path)
+	if err != nil {
+		return err
+	}
+	if pr.files != nil && fi.ModTime().Equal(pr.modTime) {
+		return nil
+	}
+	files, err := readPlaylist(pr.path)
+	if err != nil {
+		return err
+	}
+	if pr.files != nil {
+		log.Printf("source %s playlist %s reloaded: %d files", pr.label, pr.path, len(files))
+	}
+	pr.modTime = fi.ModTime()
+	if pr.shuffle {
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	}
+	pr.files = files
+	pr.next = 0
+	for i, f := range files {
+		if f == pr.current {
+			pr.next = i + 1
+			break
+		}
+	}
+	return nil
+}
+
+// openNext opens the next file in the playlist, looping (and
+// reshuffling) at the end.
+func (pr *playlistReader) openNext() error {
+	if err := pr.reload(); err != nil {
+		log.Printf("source %s playlist %s: %s", pr.label, pr.path, err)
+	}
+	for {
+		if pr.failed >= len(pr.files) {
+			return ErrEmptyPlaylist
+		}
+		if pr.next >= len(pr.files) {
+			pr.next = 0
+			if pr.shuffle {
+				rand.Shuffle(len(pr.files), func(i, j int) { pr.files[i], pr.files[j] = pr.files[j], pr.files[i] })
+			}
+		}
+		pr.current = pr.files[pr.next]
+		pr.next++
+		if err := pr.open(pr.current); err != nil {
+			log.Printf("source %s playlist %s: %s", pr.label, pr.path, err)
+			pr.failed++
+			continue
+		}
+		return nil
+	}
+}
+
+// open opens a media file, and skips its tags.
+func (pr *playlistReader) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	start, end, err := tagBounds(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if Debugging {
+		log.Printf("source %s playing %s (bytes %d-%d)", pr.label, path, start, end)
+	}
+	pr.file = f
+	pr.data = io.NewSectionReader(f, start, end-start)
+	pr.gotData = false
+	return nil
+}
+
+func (pr *playlistReader) Read(p []byte) (int, error) {
+	pr.Lock()
+	defer pr.Unlock()
+	for !pr.closed {
+		if pr.file == nil {
+			if err := pr.openNext(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := pr.data.Read(p)
+		if n > 0 {
+			pr.gotData = true
+			pr.failed = 0
+			return n, nil
+		}
+		if err == nil {
+			continue
+		}
+		if err != io.EOF {
+			log.Printf("source %s playlist %s: %s: %s", pr.label, pr.path, pr.current, err)
+		}
+		pr.file.Close()
+		pr.file = nil
+		if !pr.gotData {
+			// Count empty files as failures, so a
+			// playlist of empty files doesn't spin.
+			pr.failed++
+		}
+	}
+	return 0, ErrInputClosed
+}
+
+func (pr *playlistReader) Close() error {
+	pr.Lock()
+	defer pr.Unlock()
+	pr.closed = true
+	if pr.file != nil {
+		pr.file.Close()
+		pr.file = nil
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// id3v2Tag returns an ID3v2 tag with the given body size.
+func id3v2Tag(size int) []byte {
+	tag := make([]byte, 10+size)
+	copy(tag, "ID3\x04\x00\x00")
+	tag[6], tag[7], tag[8], tag[9] = byte(size>>21&0x7f), byte(size>>14&0x7f), byte(size>>7&0x7f), byte(size&0x7f)
+	// Album art, with something that looks like an MP3 frame
+	copy(tag[10:], []byte{0xff, 0xfb, 0x90, 0x64})
+	return tag
+}
+
+// apeTag returns an APEv2 tag with a header and the given item
+// data size.
+func apeTag(size int) []byte {
+	footer := make([]byte, apeFooterSize)
+	copy(footer, "APETAGEX")
+	binary.LittleEndian.PutUint32(footer[8:], 2000)
+	binary.LittleEndian.PutUint32(footer[12:], uint32(size+apeFooterSize))
+	binary.LittleEndian.PutUint32(footer[20:], 1<<31)
+	header := append([]byte(nil), footer...)
+	binary.LittleEndian.PutUint32(header[20:], 1<<31|1<<29)
+	return append(append(header, make([]byte, size)...), footer...)
+}
+
+// taggedFile returns the content of a media file with the given
+// audio data and all kinds of tags.
+func taggedFile(audio []byte) []byte {
+	id3v1 := make([]byte, id3v1Size)
+	copy(id3v1, "TAGtitle")
+	return bytes.Join([][]byte{id3v2Tag(300), audio, apeTag(50), id3v1}, nil)
+}
+
+func TestTagBounds(t *testing.T) {
+	audio := bytes.Repeat([]byte("a"), 1000)
+	for _, trial := range []struct {
+		content    []byte
+		start, end int64
+	}{
+		{audio, 0, 1000},
+		{taggedFile(audio), 310, 1310},
+		{append(id3v2Tag(300), audio...), 310, 1310},
+		{[]byte("ID3"), 0, 3},
+		{nil, 0, 0},
+	} {
+		start, end, err := tagBounds(bytes.NewReader(trial.content), int64(len(trial.content)))
+		if err != nil {
+			t.Error(err)
+		} else if start != trial.start || end != trial.end {
+			t.Errorf("len %d: expected %d-%d, got %d-%d", len(trial.content), trial.start, trial.end, start, end)
+		}
+	}
+}
+
+func writePlaylist(t *testing.T, dir, content string) string {
+	fn := filepath.Join(dir, "list.m3u")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestPlaylistReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamserve-playlist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "c"} {
+		ioutil.WriteFile(filepath.Join(dir, name+".mp3"), taggedFile(bytes.Repeat([]byte(name), 32)), 0644)
+	}
+	fn := writePlaylist(t, dir, "#EXTM3U\n#EXTINF:1,A\na.mp3\n\nmissing.mp3\n"+filepath.Join(dir, "b.mp3")+"\n")
+	pr, err := newPlaylistReader(fn, false, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	buf := make([]byte, 128)
+	if _, err := io.ReadFull(pr, buf); err != nil {
+		t.Fatal(err)
+	}
+	if expect := strings.Repeat("a", 32) + strings.Repeat("b", 32) + strings.Repeat("a", 32) + strings.Repeat("b", 32); string(buf) != expect {
+		t.Errorf("got %q", buf)
+	}
+
+	// Change the playlist. Playback continues after the
+	// current file, if it's still in the new list.
+	writePlaylist(t, dir, "a.mp3\nb.mp3\nc.mp3\n")
+	os.Chtimes(fn, time.Now(), time.Now().Add(time.Second))
+	if _, err := io.ReadFull(pr, buf[:96]); err != nil {
+		t.Fatal(err)
+	}
+	if expect := strings.Repeat("c", 32) + strings.Repeat("a", 32) + strings.Repeat("b", 32); string(buf[:96]) != expect {
+		t.Errorf("after reload, got %q", buf[:96])
+	}
+
+	pr.Close()
+	if _, err := pr.Read(buf); err != ErrInputClosed {
+		t.Errorf("after Close, got %v", err)
+	}
+}
+
+func TestPlaylistEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamserve-playlist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "empty.mp3"), nil, 0644)
+	if _, err := newPlaylistReader(writePlaylist(t, dir, "# nothing\n"), false, "test"); err != ErrEmptyPlaylist {
+		t.Errorf("expected ErrEmptyPlaylist, got %v", err)
+	}
+	pr, err := newPlaylistReader(writePlaylist(t, dir, "missing.mp3\nempty.mp3\n"), true, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Read(make([]byte, 16)); err != ErrEmptyPlaylist {
+		t.Errorf("expected ErrEmptyPlaylist, got %v", err)
+	}
+}
+
+func TestPlaylistSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamserve-playlist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		ioutil.WriteFile(filepath.Join(dir, name+".raw"), taggedFile(bytes.Repeat([]byte(name), 160)), 0644)
+	}
+	fn := writePlaylist(t, dir, "a.raw\nb.raw\n")
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{
+		CloseIdle:    true,
+		FrameBytes:   16,
+		Playlist:     fn,
+		RawByteRate:  16000,
+		SourceBuffer: 50,
+	})
+	defer rdr.Close()
+	t0 := time.Now()
+	readFrameKinds(t, rdr, 5*time.Second, 'a', 'b', 'a', 'b')
+	// 20-30 frames of 1ms each
+	if elapsed := time.Since(t0); elapsed < 10*time.Millisecond {
+		t.Errorf("not paced: %s", elapsed)
+	}
+}
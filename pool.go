@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// poolPollInterval is how long a pool writer waits before retrying
+// connections that weren't ready to accept more data, if no new
+// frames arrive in the meantime.
+var poolPollInterval = 10 * time.Millisecond
+
+// ErrPoolStopped is the error reported for clients whose connections
+// were closed by abortPooled, without waiting for them to finish.
+var ErrPoolStopped = errors.New("connection closed by server shutdown")
+
+// A writerPool delivers a source's frames to many clients using a
+// few writer goroutines, instead of one goroutine per client. Each
+// client is assigned to one writer. Writers use non-blocking writes,
+// so a client that isn't reading doesn't hold up the others.
+type writerPool struct {
+	source  *Source
+	writers []*poolWriter
+	next    int  // writer to assign the next client to
+	running int  // writer goroutines that haven't returned
+	closing bool // writers return when they have no clients
+	stop    chan struct{}
+	sync.Mutex
+}
+
+type poolWriter struct {
+	pool  *writerPool
+	added []*poolClient // new clients, not yet seen by run()
+	wake  chan struct{}
+}
+
+// A poolClient is a connection served by a writerPool.
+type poolClient struct {
+	conn   syscall.RawConn
+	closer io.Closer
+	reader *SourceReader
+	queue  []*frame                 // frames to write, each with a reference held
+	off    int                      // bytes of queue[0] already written
+	n      int64                    // bytes written, including headers
+	err    error                    // error to report after writing queue
+	done   func(n int64, err error) // called after the connection is closed
+	// With chunked, frames are sent as HTTP chunks, and the
+	// response ends with a last chunk and trailer (see lastChunk).
+	chunked bool
+	heads   []byte // chunk headers for the frames being written
+	tail    []byte // unwritten part of the last chunk
+	ended   bool   // tail has been set
+}
+
+// poolMaxBatch is the maximum number of buffers sent to a client in
+// one system call: one per frame, or three per frame (chunk header,
+// frame, CRLF) plus the last chunk for chunked responses.
+const poolMaxBatch = 64
+
+var crlf = []byte("\r\n")
+
+// Results of poolClient.pump().
+const (
+	pumpIdle    = iota // caught up with the source
+	pumpBlocked        // connection can't accept more data yet
+	pumpMoved          // reader moved to a different source
+	pumpDone           // finished or failed; see err
+)
+
+// writerPool returns the source's writer pool, starting one with n
+// writers if needed.
+func (s *Source) writerPool(n int) *writerPool {
+	s.Lock()
+	defer s.Unlock()
+	if p := s.pool.Load(); p != nil {
+		return p
+	}
+	if n < 1 {
+		n = 1
+	}
+	p := &writerPool{source: s, stop: make(chan struct{}), running: n}
+	for i := 0; i < n; i++ {
+		w := &poolWriter{pool: p, wake: make(chan struct{}, 1)}
+		p.writers = append(p.writers, w)
+		go w.run()
+	}
+	s.sourceMap.addPool(p)
+	s.pool.Store(p)
+	return p
+}
+
+// wakePool makes the source's pool writers (if any) check their
+// clients for new frames, or for changes to the readers' state.
+func (s *Source) wakePool() {
+	if p := s.pool.Load(); p != nil {
+		p.wake()
+	}
+}
+
+func (p *writerPool) wake() {
+	for _, w := range p.writers {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// add assigns a client to one of the pool's writers. If the pool is
+// closing, the client finishes right away.
+func (p *writerPool) add(pc *poolClient) {
+	p.source.sourceMap.pooled.Add(1)
+	p.Lock()
+	if p.closing {
+		p.Unlock()
+		pc.err = io.EOF
+		pc.finish()
+		return
+	}
+	w := p.writers[p.next]
+	p.next = (p.next + 1) % len(p.writers)
+	w.added = append(w.added, pc)
+	p.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close makes the pool's writers return when all of their clients
+// have finished. Clients can't be added after that.
+func (p *writerPool) close() {
+	p.Lock()
+	p.closing = true
+	p.Unlock()
+	p.wake()
+}
+
+// abort closes all of the pool's connections without waiting for
+// their clients to finish.
+func (p *writerPool) abort() {
+	p.Lock()
+	defer p.Unlock()
+	p.closing = true
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+}
+
+// takeAdded returns the writer's new clients. If there are none, and
+// the pool is closing, it returns ok=false.
+func (w *poolWriter) takeAdded(haveClients bool) (added []*poolClient, ok bool) {
+	p := w.pool
+	p.Lock()
+	defer p.Unlock()
+	added, w.added = w.added, nil
+	if len(added) == 0 && !haveClients && p.closing {
+		p.running--
+		if p.running == 0 {
+			p.source.sourceMap.removePool(p)
+		}
+		return nil, false
+	}
+	return added, true
+}
+
+func (w *poolWriter) run() {
+	var clients []*poolClient
+	iov := make([]syscall.Iovec, poolMaxBatch)
+	for {
+		added, ok := w.takeAdded(len(clients) > 0)
+		if !ok {
+			return
+		}
+		clients = append(clients, added...)
+		blocked := false
+		kept := clients[:0]
+		for _, pc := range clients {
+			switch pc.pump(iov) {
+			case pumpBlocked:
+				blocked = true
+				kept = append(kept, pc)
+			case pumpIdle:
+				kept = append(kept, pc)
+			case pumpMoved:
+				// Continue in the new source's pool.
+				pc.reader.source.writerPool(len(w.pool.writers)).add(pc)
+				w.pool.source.sourceMap.pooled.Done()
+			case pumpDone:
+				pc.finish()
+			}
+		}
+		for i := len(kept); i < len(clients); i++ {
+			clients[i] = nil
+		}
+		clients = kept
+		var retry <-chan time.Time
+		if blocked {
+			retry = time.After(poolPollInterval)
+		}
+		select {
+		case <-w.wake:
+		case <-retry:
+		case <-w.pool.stop:
+			added, _ = w.takeAdded(true)
+			for _, pc := range append(clients, added...) {
+				pc.err = ErrPoolStopped
+				pc.finish()
+			}
+			w.takeAdded(false)
+			return
+		}
+	}
+}
+
+// pump writes as much data to the client as it can without blocking.
+// iov is scratch space for writev.
+func (pc *poolClient) pump(iov []syscall.Iovec) int {
+	maxQueue := len(iov)
+	if pc.chunked {
+		maxQueue = (len(iov) - 1) / 3
+	}
+	for {
+		for pc.err == nil && len(pc.queue) < maxQueue {
+			src := pc.reader.source
+			f, err := pc.reader.nextFrameRef(false)
+			if err != nil {
+				pc.err = err
+				break
+			}
+			if f != nil {
+				pc.reader.advance(f)
+				pc.queue = append(pc.queue, f)
+			}
+			if pc.reader.source != src {
+				return pumpMoved
+			} else if f == nil {
+				break
+			}
+		}
+		if len(pc.queue) == 0 && pc.err != nil && pc.chunked && !pc.ended {
+			pc.ended = true
+			pc.tail = pc.lastChunk()
+		}
+		if len(pc.queue) == 0 && len(pc.tail) == 0 {
+			if pc.err != nil {
+				return pumpDone
+			}
+			return pumpIdle
+		}
+		n, err := pc.writev(iov)
+		pc.n += int64(n)
+		pc.consume(n)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			pc.unqueue()
+			return pumpBlocked
+		} else if err != nil {
+			pc.err = err
+			return pumpDone
+		}
+	}
+}
+
+// writev writes the queued frames to the connection, without waiting
+// for it to be ready to accept data. It returns syscall.EAGAIN if no
+// data could be written.
+func (pc *poolClient) writev(iov []syscall.Iovec) (n int, err error) {
+	k, off := 0, pc.off
+	add := func(data []byte) {
+		if off >= len(data) {
+			off -= len(data)
+			return
+		}
+		data = data[off:]
+		off = 0
+		iov[k].Base = &data[0]
+		iov[k].SetLen(len(data))
+		k++
+	}
+	// pc.heads has room for all of the chunk headers, so
+	// appending doesn't move the ones already added to iov.
+	pc.heads = pc.heads[:0]
+	for _, f := range pc.queue {
+		if !pc.chunked {
+			add(f.data)
+			continue
+		}
+		start := len(pc.heads)
+		pc.heads = strconv.AppendInt(pc.heads, int64(len(f.data)), 16)
+		pc.heads = append(pc.heads, crlf...)
+		add(pc.heads[start:])
+		add(f.data)
+		add(crlf)
+	}
+	add(pc.tail)
+	iov = iov[:k]
+	werr := pc.conn.Write(func(fd uintptr) bool {
+		r, _, errno := syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if errno != 0 {
+			err = errno
+		} else {
+			n = int(r)
+		}
+		return true
+	})
+	for i := range iov {
+		iov[i].Base = nil
+	}
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// unqueue gives back the queued frames that haven't been started, so
+// a client whose connection is full doesn't hold references to them.
+// They will be queued again (or skipped, if the client falls too far
+// behind) when the connection is ready.
+func (pc *poolClient) unqueue() {
+	keep := 0
+	if pc.off > 0 {
+		keep = 1
+	}
+	for i := len(pc.queue) - 1; i >= keep; i-- {
+		pc.reader.unread(pc.queue[i])
+		pc.queue[i].release()
+		pc.queue[i] = nil
+	}
+	pc.queue = pc.queue[:keep]
+	if pc.err == io.EOF && !pc.ended {
+		// Try again when the unqueued frames have been sent.
+		pc.err = nil
+	}
+}
+
+// consume releases frames from the front of the queue after n bytes
+// have been written, and then consumes the tail.
+func (pc *poolClient) consume(n int) {
+	done := 0
+	for done < len(pc.queue) && n > 0 {
+		remain := pc.wireLen(pc.queue[done]) - pc.off
+		if n < remain {
+			pc.off += n
+			n = 0
+			break
+		}
+		n -= remain
+		pc.off = 0
+		pc.queue[done].release()
+		pc.queue[done] = nil
+		done++
+	}
+	if n > 0 {
+		pc.tail = pc.tail[n:]
+	}
+	kept := copy(pc.queue, pc.queue[done:])
+	for i := kept; i < len(pc.queue); i++ {
+		pc.queue[i] = nil
+	}
+	pc.queue = pc.queue[:kept]
+}
+
+// wireLen returns the number of bytes written for f, including its
+// chunk header and CRLF if the response is chunked.
+func (pc *poolClient) wireLen(f *frame) int {
+	n := len(f.data)
+	if !pc.chunked {
+		return n
+	}
+	digits := 1
+	for x := n >> 4; x > 0; x >>= 4 {
+		digits++
+	}
+	return n + digits + 2*len(crlf)
+}
+
+// lastChunk returns the end of a chunked response: the last chunk,
+// and a trailer naming the slow client policy that disconnected the
+// client, if any.
+func (pc *poolClient) lastChunk() []byte {
+	b := []byte("0\r\n")
+	if e, ok := pc.err.(*SlowClientError); ok {
+		b = append(b, slowClientTrailer+": "+e.Policy+"\r\n"...)
+	}
+	return append(b, crlf...)
+}
+
+// finish closes the client's connection and calls its done func.
+func (pc *poolClient) finish() {
+	for _, f := range pc.queue {
+		f.release()
+	}
+	pc.queue = nil
+	pc.closer.Close()
+	if pc.err == io.EOF || pc.err == syscall.EPIPE || pc.err == syscall.ECONNRESET {
+		// Not really an error: source ended, or client
+		// disconnected.
+		pc.err = nil
+	}
+	sm := pc.reader.source.sourceMap
+	pc.done(pc.n, pc.err)
+	sm.pooled.Done()
+}
+
+// servePooled takes over the client's connection, sends the response
+// headers and the source's header, and hands the connection to the
+// source's writer pool. If chunked is true, the response is chunked,
+// so it can end with the slow client policy trailer. done is called
+// when the client finishes, or right away if the connection can't be
+// served this way.
+func servePooled(w http.ResponseWriter, sr *SourceReader, c *Config, chunked bool, done func(int64, error)) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		done(0, errors.New("connection cannot be hijacked"))
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		done(0, err)
+		return
+	}
+	var raw syscall.RawConn
+	if sc, ok := conn.(syscall.Conn); !ok {
+		err = errors.New("connection does not support non-blocking writes")
+	} else {
+		raw, err = sc.SyscallConn()
+	}
+	var n int64
+	if err == nil {
+		n, err = writePooledHeader(bufrw.Writer, sr, c, chunked)
+	}
+	if err != nil {
+		conn.Close()
+		done(n, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	pc := &poolClient{
+		conn:    raw,
+		closer:  conn,
+		reader:  sr,
+		n:       n,
+		done:    done,
+		chunked: chunked,
+	}
+	if chunked {
+		// Room for a 16-digit hex length and CRLF per frame.
+		pc.heads = make([]byte, 0, poolMaxBatch/3*18)
+	}
+	sr.source.writerPool(c.PoolWriters).add(pc)
+}
+
+// writePooledHeader sends the HTTP response headers and the source's
+// header (if any) on a hijacked connection.
+func writePooledHeader(w *bufio.Writer, sr *SourceReader, c *Config, chunked bool) (int64, error) {
+	fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nConnection: close\r\n", c.ContentType)
+	if chunked {
+		fmt.Fprintf(w, "Transfer-Encoding: chunked\r\nTrailer: %s\r\n", slowClientTrailer)
+	}
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	sr.didHeader = true
+	header, err := sr.source.getHeader()
+	if err != nil || header == nil {
+		return 0, err
+	}
+	if chunked {
+		fmt.Fprintf(w, "%x\r\n", len(header))
+	}
+	nw, err := w.Write(header)
+	if chunked {
+		w.Write(crlf)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	atomic.AddUint64(&sr.source.statBytesOut, uint64(nw))
+	return int64(nw), err
+}
+
+func (sm *SourceMap) addPool(p *writerPool) {
+	sm.poolsLock.Lock()
+	defer sm.poolsLock.Unlock()
+	if sm.pools == nil {
+		sm.pools = make(map[*writerPool]bool)
+	}
+	sm.pools[p] = true
+}
+
+func (sm *SourceMap) removePool(p *writerPool) {
+	sm.poolsLock.Lock()
+	defer sm.poolsLock.Unlock()
+	delete(sm.pools, p)
+}
+
+// waitPooled waits for all clients served by writer pools to finish.
+// If ctx is done first, it closes their connections and returns
+// ctx's error.
+func (sm *SourceMap) waitPooled(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		sm.pooled.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		sm.abortPooled()
+		return ctx.Err()
+	}
+}
+
+// abortPooled closes all connections served by writer pools.
+func (sm *SourceMap) abortPooled() {
+	sm.poolsLock.Lock()
+	defer sm.poolsLock.Unlock()
+	for p := range sm.pools {
+		p.abort()
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPoolDelivery(t *testing.T) {
+	nClients := 20
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:           ":0",
+		ClientMaxBytes: 1 << 16,
+		ContentType:    "audio/foo",
+		Delivery:       "pool",
+		FrameBytes:     1 << 10,
+		HeaderBytes:    100,
+		Path:           "/dev/zero",
+		PoolWriters:    3,
+		Reopen:         true,
+		SourceBuffer:   64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < nClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != "audio/foo" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if len(body) != 100+1<<16 {
+				t.Errorf("got %d bytes, expected header + %d", len(body), 1<<16)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolSlowClient(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		Delivery:        "pool",
+		FrameBytes:      1 << 12,
+		Path:            "/dev/zero",
+		PoolWriters:     1,
+		Reopen:          true,
+		SourceBandwidth: 1 << 23,
+		SourceBuffer:    64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// This client never reads, so its connection fills up.
+	slow, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.(*net.TCPConn).SetReadBuffer(1 << 12)
+	fmt.Fprintf(slow, "GET / HTTP/1.0\r\n\r\n")
+	time.Sleep(time.Second)
+	// The same writer must keep sending to other clients.
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadFull(resp.Body, make([]byte, 1<<21))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out: slow client is blocking pool writer")
+	}
+}
+
+func TestPoolSlowClientTrailer(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:               ":0",
+		Delivery:           "pool",
+		FrameBytes:         1 << 14,
+		HeaderBytes:        100,
+		Path:               "/dev/zero",
+		Reopen:             true,
+		SlowClientPolicy:   policyDisconnectAfterSkips,
+		SlowClientMaxSkips: 10,
+		SourceBandwidth:    1 << 25,
+		SourceBuffer:       5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadFull(resp.Body, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// Fall behind (after the connection's buffers fill up), so
+	// the policy disconnects us.
+	time.Sleep(time.Second)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("after %d bytes: %s", len(body), err)
+	}
+	if len(body)%(1<<14) != 0 {
+		t.Errorf("got %d bytes, not a multiple of frame size", len(body))
+	}
+	if got := resp.Trailer.Get(slowClientTrailer); got != policyDisconnectAfterSkips {
+		t.Errorf("trailer %q, expected %q", got, policyDisconnectAfterSkips)
+	}
+}
+
+func TestPoolShutdownFinishesFrame(t *testing.T) {
+	frameBytes := 1000
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		Delivery:        "pool",
+		FrameBytes:      uint64(frameBytes),
+		Path:            "/dev/zero",
+		Reopen:          true,
+		SourceBandwidth: 100000,
+		SourceBuffer:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadFull(resp.Body, make([]byte, frameBytes/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("client got error %s", err)
+	}
+	got += len(rest)
+	if got%frameBytes != 0 {
+		t.Errorf("client got %d bytes, not a multiple of frame size %d", got, frameBytes)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkDeliveryGoroutine1000Clients(b *testing.B) {
+	deliveryCost(b, "goroutine", 1000)
+}
+
+func BenchmarkDeliveryPool1000Clients(b *testing.B) {
+	deliveryCost(b, "pool", 1000)
+}
+
+// deliveryCost connects nClients clients, then waits for each of
+// them to receive b.N frames. It reports the memory and goroutines
+// used per connected client, and CPU time per frame per client.
+//
+// The clients run in the same process, so their own costs are
+// included; compare results between delivery modes rather than
+// reading them as absolute numbers.
+func deliveryCost(b *testing.B, delivery string, nClients int) {
+	frameBytes := 1 << 10
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		Delivery:        delivery,
+		FrameBytes:      uint64(frameBytes),
+		Path:            "/dev/zero",
+		PoolWriters:     4,
+		Reopen:          true,
+		SourceBandwidth: uint64(frameBytes) << 12,
+		SourceBuffer:    64,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+	memBefore, goroutinesBefore := memInUse(), runtime.NumGoroutine()
+	var connected, finished sync.WaitGroup
+	start := make(chan struct{})
+	connected.Add(nClients)
+	finished.Add(nClients)
+	for i := 0; i < nClients; i++ {
+		go func() {
+			defer finished.Done()
+			conn, err := net.Dial("tcp", srv.Addr)
+			if err != nil {
+				b.Error(err)
+				connected.Done()
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+			rdr := bufio.NewReaderSize(conn, frameBytes)
+			rdr.Peek(1)
+			connected.Done()
+			<-start
+			buf := make([]byte, frameBytes)
+			for got := 0; got < b.N*frameBytes; {
+				n, err := rdr.Read(buf)
+				got += n
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	connected.Wait()
+	mem, goroutines := memInUse()-memBefore, runtime.NumGoroutine()-goroutinesBefore
+	cpuBefore := cpuTime()
+	b.ResetTimer()
+	close(start)
+	finished.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(mem)/float64(nClients), "B/client")
+	b.ReportMetric(float64(goroutines)/float64(nClients), "goroutines/client")
+	b.ReportMetric(float64(cpuTime()-cpuBefore)/float64(nClients*b.N), "cpu-ns/client-frame")
+}
+
+// memInUse returns the number of bytes of heap and stack in use,
+// after a garbage collection.
+func memInUse() int64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse + ms.StackInuse)
+}
+
+// cpuTime returns the user+system CPU time used by this process.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
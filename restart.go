@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// restartPolicy controls how a source reopens its input after it
+// fails (see -reopen).
+type restartPolicy struct {
+	delay      time.Duration // first delay, and minimum time between attempts
+	delayMax   time.Duration // maximum delay
+	failCount  int           // consecutive failures that put the source in the failed state
+	failWindow time.Duration // ...if they all happen within this time
+}
+
+func (c *Config) restartPolicy() restartPolicy {
+	return restartPolicy{
+		delay:      c.RestartDelay,
+		delayMax:   c.RestartDelayMax,
+		failCount:  c.RestartFailCount,
+		failWindow: c.RestartFailWindow,
+	}
+}
+
+// backoff returns the delay before the next attempt, after the given
+// number of consecutive failures: delay, doubling after each
+// failure, up to delayMax, with random jitter of up to half the
+// delay.
+func (rp restartPolicy) backoff(failures int) time.Duration {
+	d := rp.delay
+	for i := 1; i < failures && d < rp.delayMax; i++ {
+		d *= 2
+	}
+	if d > rp.delayMax {
+		d = rp.delayMax
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// waitRestart records whether the last attempt to open the input
+// failed (either the open itself failed, or the input closed before
+// supplying a frame), and waits before the next attempt. It returns
+// false if the source was closed while waiting.
+func (s *Source) waitRestart(failed bool) bool {
+	rp := s.restartPolicy()
+	now := time.Now()
+	if !failed {
+		s.restartFailures = s.restartFailures[:0]
+	} else {
+		atomic.AddUint64(&s.statRestartFailures, 1)
+		// Keep the consecutive failures within the window.
+		recent := s.restartFailures[:0]
+		for _, t := range s.restartFailures {
+			if now.Sub(t) < rp.failWindow {
+				recent = append(recent, t)
+			}
+		}
+		s.restartFailures = append(recent, now)
+		if rp.failCount > 0 && len(s.restartFailures) >= rp.failCount && !s.isFailed() {
+			log.Printf("source %s failed: %d restarts in %s", s.label, len(s.restartFailures), rp.failWindow)
+			atomic.StoreInt32(&s.failed, 1)
+		}
+	}
+	if failed {
+		s.restartCount++
+	} else {
+		s.restartCount = 0
+	}
+	delay := rp.backoff(s.restartCount)
+	if delay <= 0 {
+		return !s.gone
+	}
+	if Debugging {
+		log.Printf("source %s reopen in %s", s.label, delay)
+	}
+	select {
+	case <-time.After(delay):
+	case <-s.done:
+	}
+	return !s.gone
+}
+
+// checkRecovered clears the failed state when the input supplies a
+// frame.
+func (s *Source) checkRecovered() {
+	if !s.isFailed() {
+		return
+	}
+	log.Printf("source %s recovered", s.label)
+	atomic.StoreInt32(&s.failed, 0)
+	s.restartFailures = s.restartFailures[:0]
+	s.restartCount = 0
+	if s.closeIdle {
+		// Clients were refused while the source was failed, so
+		// it might be idle.
+		go s.closeIfIdle()
+	}
+}
+
+func (s *Source) restartPolicy() restartPolicy {
+	s.RLock()
+	defer s.RUnlock()
+	return s.restart
+}
+
+// isFailed returns true if the source's input keeps failing (see
+// -restart-fail-count). New clients are refused until it recovers.
+func (s *Source) isFailed() bool {
+	return atomic.LoadInt32(&s.failed) != 0
+}
+
+// Failed returns true if the source for the given path exists and
+// is in the failed state.
+func (sm *SourceMap) Failed(path string) bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	src, ok := sm.sources[path]
+	return ok && src.isFailed()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	rp := restartPolicy{delay: 100 * time.Millisecond, delayMax: time.Second}
+	for _, trial := range []struct {
+		failures int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+		{100, 500 * time.Millisecond, time.Second},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := rp.backoff(trial.failures); d < trial.min || d > trial.max {
+				t.Errorf("%d failures: %s not in %s-%s", trial.failures, d, trial.min, trial.max)
+			}
+		}
+	}
+	if d := (restartPolicy{}).backoff(3); d != 0 {
+		t.Errorf("no delay configured: got %s", d)
+	}
+}
+
+func crashLoopConfig() *Config {
+	return &Config{
+		Args:              []string{"sh", "-c", "exit 1"},
+		ExecFlag:          true,
+		FrameBytes:        4,
+		Reopen:            true,
+		RestartDelay:      time.Millisecond,
+		RestartDelayMax:   time.Second,
+		RestartFailCount:  3,
+		RestartFailWindow: time.Minute,
+		SourceBuffer:      10,
+	}
+}
+
+func TestSourceFails(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/stream", crashLoopConfig())
+	defer rdr.Close()
+	t0 := time.Now()
+	for !sm.Failed("/stream") {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("source did not fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := rdr.source.Status(); !st.Failed {
+		t.Error("status does not show failed")
+	}
+	if n := atomic.LoadUint64(&rdr.source.statRestartFailures); n < 3 {
+		t.Errorf("expected >= 3 failures, got %d", n)
+	}
+	// Backoff: 3 failures take at least 1+2 ms (with jitter,
+	// 0.5+1ms), not a tight loop.
+	if n := atomic.LoadUint64(&rdr.source.statReopens); n > 10 {
+		t.Errorf("%d reopens", n)
+	}
+}
+
+func TestShortInputsDontFail(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	c := crashLoopConfig()
+	// Like a FIFO with short-lived writers: each input supplies a
+	// frame, then closes.
+	c.Args = []string{"sh", "-c", "printf abcd"}
+	rdr := sm.NewReader("/stream", c)
+	defer rdr.Close()
+	t0 := time.Now()
+	for atomic.LoadUint64(&rdr.source.statReopens) < 5 {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("source did not reopen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sm.Failed("/stream") {
+		t.Error("source failed")
+	}
+	if n := atomic.LoadUint64(&rdr.source.statRestartFailures); n > 0 {
+		t.Errorf("%d failures", n)
+	}
+}
+
+func TestServerRefusesFailedSource(t *testing.T) {
+	c := crashLoopConfig()
+	c.Addr = ":0"
+	c.Path = "/dev/stdin"
+	c.Args = []string{"sh", "-c", "sleep 0.01"}
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// The first client starts the source, and waits.
+	go http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	t0 := time.Now()
+	for !srv.sourceMap.Failed(c.SourceKey()) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("source did not fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("got %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
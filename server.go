@@ -1,15 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,30 +23,63 @@ type Server struct {
 	Err        error  // error encountered while running server (nil if still listening)
 	config     Config
 	listener   *net.TCPListener
-	shutdown   bool // shutdown was requested by Close()
+	shutdown   bool // shutdown was requested by Close() or Shutdown()
 	done       bool // server is no longer listening
+	draining   bool // Shutdown() is waiting for clients to finish
 	*sync.Cond      // can wait for done to become true
+	stateLock  *sync.RWMutex
 	sourceMap  *SourceMap
+	mounts     map[string]*Config // current mounts, updated by Reload()
+	mountsLock sync.RWMutex
+	limiter    clientLimiter
+	authKeys   atomic.Pointer[AuthKeys] // from -auth-key-file
+	// for -auth-webhook
+	webhookClient *http.Client
+	webhooks      sync.WaitGroup // pending disconnect notifications
 }
 
 // FlushyResponseWriter wraps http.ResponseWriter, calling Flush()
-// after each Write() to minimize buffering on our (server) end of the
+// after writes to minimize buffering on our (server) end of the
 // connection.
+//
+// If MaxBytes is zero, it flushes after every Write(). Otherwise, it
+// flushes when at least MaxBytes bytes, or any bytes written more
+// than MaxDelay ago, are waiting to be flushed. This lets a client
+// that is lagging behind receive several frames per system call.
+// SourceReader's WriteTo also calls Flush() whenever the reader
+// catches up with its source, so clients that are keeping up don't
+// wait for buffered frames.
 type FlushyResponseWriter struct {
 	http.ResponseWriter
+	MaxBytes   int
+	MaxDelay   time.Duration
+	unflushed  int
+	firstWrite time.Time // time of the oldest unflushed write
 }
 
 // Write sends data to the client. It panics if the underlying
 // ResponseWriter does not implement http.Flusher.
 func (writer *FlushyResponseWriter) Write(data []byte) (int, error) {
-	defer func() {
-		flusher, ok := writer.ResponseWriter.(http.Flusher)
-		if !ok {
-			log.Fatal("ResponseWriter is not a flusher")
-		}
-		flusher.Flush()
-	}()
-	return writer.ResponseWriter.Write(data)
+	n, err := writer.ResponseWriter.Write(data)
+	if writer.unflushed == 0 {
+		writer.firstWrite = time.Now()
+	}
+	writer.unflushed += n
+	if writer.unflushed >= writer.MaxBytes ||
+		(writer.MaxDelay > 0 && time.Since(writer.firstWrite) >= writer.MaxDelay) {
+		writer.Flush()
+	}
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+func (writer *FlushyResponseWriter) Flush() {
+	flusher, ok := writer.ResponseWriter.(http.Flusher)
+	if !ok {
+		log.Fatal("ResponseWriter is not a flusher")
+	}
+	flusher.Flush()
+	writer.unflushed = 0
 }
 
 // Run starts an HTTP server with the given configuration.
@@ -53,13 +89,18 @@ func (srv *Server) Run(c *Config) (err error) {
 		log.Fatal(err)
 	}
 	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(c.CPUMax))
-	addr, err := net.ResolveTCPAddr("tcp", c.Addr)
-	if err != nil {
-		return
-	}
-	srv.listener, err = net.ListenTCP("tcp", addr)
-	if err != nil {
+	if srv.listener, err = systemdListener(); err != nil {
 		return
+	} else if srv.listener == nil {
+		var addr *net.TCPAddr
+		addr, err = net.ResolveTCPAddr("tcp", c.Addr)
+		if err != nil {
+			return
+		}
+		srv.listener, err = net.ListenTCP("tcp", addr)
+		if err != nil {
+			return
+		}
 	}
 	if c.UID != os.Getuid() && c.UID != 0 {
 		err = syscall.Setuid(c.UID)
@@ -69,61 +110,200 @@ func (srv *Server) Run(c *Config) (err error) {
 		}
 	}
 	srv.Addr = srv.listener.Addr().String()
+	srv.config = *c
+	srv.mounts = c.Mounts
 	srv.sourceMap = NewSourceMap()
+	if c.AuthKeyFile != "" {
+		if err = srv.loadAuthKeys(); err != nil {
+			srv.listener.Close()
+			return
+		}
+	}
+	srv.webhookClient = newWebhookClient(c)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
-		log.Println("client", req.RemoteAddr, c.Path)
-		writer.Header().Set("Content-Type", config.ContentType)
-		startTime := time.Now()
-		sreader := srv.sourceMap.NewReader(c.Path, c)
-		fwriter := &FlushyResponseWriter{writer}
-		wroteBytes, err := io.Copy(fwriter,
-			bufio.NewReaderSize(sreader, int(c.FrameBytes)))
-		if e, ok := err.(*net.OpError); ok {
-			if e, ok := e.Err.(syscall.Errno); ok {
-				if e == syscall.ECONNRESET {
-					// Not really an error: client disconnected.
-					err = nil
+		srv.stateLock.RLock()
+		draining := srv.draining
+		srv.stateLock.RUnlock()
+		if draining {
+			// Sources are stopping. Don't attach a new
+			// client (or start a new source) that Shutdown
+			// would have to wait for.
+			writer.Header().Set("Connection", "close")
+			http.Error(writer, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		mc := srv.mount(req.URL.Path)
+		if mc == nil {
+			http.NotFound(writer, req)
+			return
+		}
+		if !mc.Permits(req.RemoteAddr) {
+			log.Println("client", req.RemoteAddr, "denied", mc.SourceKey())
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+		limits := clientLimits{
+			maxDuration:   mc.ClientMaxDuration,
+			maxStreamTime: mc.ClientMaxStreamTime,
+		}
+		var tl clientLimits // from the token or signed URL
+		if mc.RequireAuth {
+			var err error
+			tl, err = srv.authKeys.Load().authorize(req, time.Now())
+			if err != nil {
+				log.Println("client", req.RemoteAddr, "unauthorized", mc.SourceKey()+":", err)
+				if err.(*authError).status == http.StatusUnauthorized {
+					writer.Header().Set("WWW-Authenticate", "Bearer")
 				}
+				http.Error(writer, err.Error(), err.(*authError).status)
+				return
 			}
+			limits.override(tl)
 		}
+		if srv.sourceMap.Failed(mc.SourceKey()) {
+			log.Println("client", req.RemoteAddr, "refused", mc.SourceKey()+": source failed")
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(mc.RestartDelayMax.Seconds()))))
+			http.Error(writer, "Source failed", http.StatusServiceUnavailable)
+			return
+		}
+		release, err := srv.limiter.admit(&srv.config, mc, req.RemoteAddr)
 		if err != nil {
-			log.Printf("client %s error: %s", req.RemoteAddr, err)
-		}
-		log.Println("client", req.RemoteAddr,
-			"--", time.Since(startTime).String(), "elapsed",
-			wroteBytes, "bytes",
-			sreader.FramesRead, "frames +",
-			sreader.FramesSkipped, "skipped")
-		sreader.Close()
-		if srv.sourceMap.Count() == 0 && !c.Reopen {
-			// The only source path has ended and can't be reopened.
-			srv.Close()
+			// Refuse before NewClientReader, so we
+			// don't open an idle source.
+			log.Println("client", req.RemoteAddr, "refused", mc.SourceKey()+":", err)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(srv.config.LimitRetryAfter.Seconds()))))
+			http.Error(writer, err.Error(), err.(*limitError).status)
+			return
 		}
+		var hook *webhookReply
+		if mc.AuthWebhook != "" {
+			if hook, err = srv.webhookConnect(mc, req); err != nil {
+				log.Println("client", req.RemoteAddr, "refused by webhook", mc.SourceKey()+":", err)
+				release()
+				http.Error(writer, err.Error(), err.(*authError).status)
+				return
+			}
+			limits.override(hook.limits)
+			limits.restrict(tl)
+		}
+		log.Println("client", req.RemoteAddr, mc.SourceKey())
+		writer.Header().Set("Content-Type", mc.ContentType)
+		trailer := mc.SlowClientPolicy != "" && mc.SlowClientPolicy != policySkip
+		if trailer {
+			writer.Header().Set("Trailer", slowClientTrailer)
+		}
+		startTime := time.Now()
+		sreader := srv.sourceMap.NewClientReader(mc.SourceKey(), mc, req.RemoteAddr)
+		limits.apply(sreader, startTime)
+		done := func(wroteBytes int64, err error) {
+			if e, ok := err.(*net.OpError); ok {
+				if e, ok := e.Err.(syscall.Errno); ok {
+					if e == syscall.ECONNRESET {
+						// Not really an error: client disconnected.
+						err = nil
+					}
+				}
+			}
+			if e, ok := err.(*SlowClientError); ok {
+				// Tell the client why (if it's still
+				// listening, and the response is
+				// chunked).
+				writer.Header().Set(slowClientTrailer, e.Policy)
+			}
+			if err != nil {
+				log.Printf("client %s error: %s", req.RemoteAddr, err)
+			}
+			log.Println("client", req.RemoteAddr,
+				"--", time.Since(startTime).String(), "elapsed",
+				wroteBytes, "bytes",
+				sreader.FramesRead, "frames +",
+				sreader.FramesSkipped, "skipped")
+			if hook != nil {
+				ev := &disconnectEvent{
+					Session:       hook.Session,
+					Client:        sreader.ID,
+					RemoteAddr:    req.RemoteAddr,
+					Path:          req.URL.Path,
+					Bytes:         wroteBytes,
+					FramesRead:    sreader.FramesRead,
+					FramesSkipped: sreader.FramesSkipped,
+					Seconds:       time.Since(startTime).Seconds(),
+				}
+				if err != nil {
+					ev.Error = err.Error()
+				}
+				srv.webhookDisconnect(mc, ev)
+			}
+			sreader.Close()
+			release()
+			if c.Mounts == nil && srv.sourceMap.Count() == 0 && !c.Reopen {
+				// The only source path has ended and can't be reopened.
+				srv.Close()
+			}
+		}
+		if mc.Delivery == "pool" {
+			// Hand the connection to the source's writer
+			// pool, and return without waiting for the
+			// client to finish.
+			servePooled(writer, sreader, mc, trailer && req.ProtoAtLeast(1, 1), done)
+			return
+		}
+		fwriter := &FlushyResponseWriter{
+			ResponseWriter: writer,
+			MaxBytes:       int(mc.FlushBytes),
+			MaxDelay:       mc.FlushInterval,
+		}
+		done(io.Copy(fwriter, sreader))
 	})
+	if c.MetricsPath != "" {
+		mux.HandleFunc(c.MetricsPath, func(writer http.ResponseWriter, req *http.Request) {
+			writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			srv.sourceMap.WriteMetrics(writer)
+		})
+	}
+	if c.AdminPath != "" {
+		var ah *adminHandler
+		if ah, err = newAdminHandler(c.AdminPath, c.AdminTokenFile, srv.sourceMap); err != nil {
+			srv.listener.Close()
+			return
+		}
+		mux.Handle(ah.prefix+"/", ah)
+	}
 	srv.Handler = mux
-	mutex := &sync.RWMutex{}
-	srv.Cond = sync.NewCond(mutex.RLocker())
+	srv.stateLock = &sync.RWMutex{}
+	srv.Cond = sync.NewCond(srv.stateLock.RLocker())
 	go func() {
 		err = srv.Serve(tcpKeepAliveListener{srv.listener})
 		if !srv.shutdown {
 			srv.Err = err
 		}
-		mutex.Lock()
+		srv.stateLock.Lock()
 		srv.done = true
 		srv.Cond.Broadcast()
-		mutex.Unlock()
+		srv.stateLock.Unlock()
 	}()
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("sd_notify: %s", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		if !c.detectsFailure() {
+			log.Printf("watchdog: -restart-fail-count is not set, so failed sources won't trigger a restart")
+		}
+		go srv.runWatchdog(interval)
+	}
 	return nil
 }
 
-// Wait returns when the server stops listening. If the server stops
-// because Close() was called, it returns nil. If it stops for some
-// other reason, it returns the error that caused it to stop.
+// Wait returns when the server stops listening (and, if Shutdown()
+// was called, when Shutdown() is finished). If the server stops
+// because Close() or Shutdown() was called, it returns nil. If it
+// stops for some other reason, it returns the error that caused it
+// to stop.
 func (srv *Server) Wait() error {
 	srv.Cond.L.Lock()
 	defer srv.Cond.L.Unlock()
-	for !srv.done {
+	for !srv.done || srv.draining {
 		log.Print("waiting")
 		srv.Cond.Wait()
 	}
@@ -133,12 +313,48 @@ func (srv *Server) Wait() error {
 // Close shuts down the server. It returns an error if the server
 // already stopped for some reason other than a prior call to Close().
 func (srv *Server) Close() error {
+	sdNotify("STOPPING=1")
 	srv.shutdown = true
 	srv.listener.Close()
 	srv.sourceMap.Close()
 	return srv.Wait()
 }
 
+// Shutdown shuts down the server gracefully. It stops accepting new
+// connections, disconnects each client when it has received the
+// frame it is currently reading, and then closes all sources. If
+// clients are still connected when ctx is done, their connections
+// are closed without waiting.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	sdNotify("STOPPING=1")
+	srv.stateLock.Lock()
+	srv.shutdown = true
+	srv.draining = true
+	srv.stateLock.Unlock()
+	defer func() {
+		srv.stateLock.Lock()
+		srv.draining = false
+		srv.Cond.Broadcast()
+		srv.stateLock.Unlock()
+	}()
+	srv.sourceMap.Stop()
+	err := srv.Server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown: %s; closing remaining connections", err)
+		srv.Server.Close()
+	}
+	if perr := srv.sourceMap.waitPooled(ctx); perr != nil && err == nil {
+		log.Printf("shutdown: %s; closed remaining pooled connections", perr)
+		err = perr
+	}
+	srv.sourceMap.Close()
+	if werr := srv.waitWebhooks(ctx); werr != nil && err == nil {
+		log.Printf("shutdown: %s; abandoned disconnect webhooks", werr)
+		err = werr
+	}
+	return err
+}
+
 // Copied from net/http because not exported.
 //
 type tcpKeepAliveListener struct {
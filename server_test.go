@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"sync"
 	"sync/atomic"
@@ -161,3 +163,157 @@ func devZeroToClients(b *testing.B, nClients int, nBytesPerClient int) {
 	srv.Close()
 	// Wait for server to stop
 }
+
+func TestShutdownFinishesFrame(t *testing.T) {
+	frameBytes := 1000
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		FrameBytes:      uint64(frameBytes),
+		Path:            "/dev/zero",
+		Reopen:          true,
+		SourceBandwidth: 100000,
+		SourceBuffer:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// Read part of a frame, so the server is likely to be
+	// mid-frame when shutdown starts.
+	got, err := io.ReadFull(resp.Body, make([]byte, frameBytes/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("client got error %s", err)
+	}
+	got += len(rest)
+	if got%frameBytes != 0 {
+		t.Errorf("client got %d bytes, not a multiple of frame size %d", got, frameBytes)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Error(err)
+	}
+	if err := srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr)); err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestShutdownRefusesNewStreams(t *testing.T) {
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:         ":0",
+		FrameBytes:   16,
+		Path:         "/dev/zero",
+		Reopen:       true,
+		SourceBuffer: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// Shutdown has stopped the sources, but the listener is
+	// still open.
+	srv.stateLock.Lock()
+	srv.draining = true
+	srv.stateLock.Unlock()
+	srv.sourceMap.Stop()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %s", resp.Status)
+	}
+	if n := srv.sourceMap.Count(); n != 0 {
+		t.Errorf("started %d sources", n)
+	}
+	// A source created after Stop is stopped, too.
+	rdr := srv.sourceMap.NewReader("/dev/zero", &srv.config)
+	defer rdr.Close()
+	if _, err := rdr.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	srv.stateLock.Lock()
+	srv.draining = false
+	srv.stateLock.Unlock()
+}
+
+type countingFlusher struct {
+	http.ResponseWriter
+	flushes int
+}
+
+func (cf *countingFlusher) Flush() {
+	cf.flushes++
+}
+
+func TestFlushyResponseWriter(t *testing.T) {
+	cf := &countingFlusher{ResponseWriter: httptest.NewRecorder()}
+	fw := &FlushyResponseWriter{ResponseWriter: cf}
+	fw.Write([]byte("foo"))
+	fw.Write([]byte("bar"))
+	if cf.flushes != 2 {
+		t.Errorf("MaxBytes=0: got %d flushes, expected 2", cf.flushes)
+	}
+
+	cf = &countingFlusher{ResponseWriter: httptest.NewRecorder()}
+	fw = &FlushyResponseWriter{ResponseWriter: cf, MaxBytes: 10, MaxDelay: time.Hour}
+	for i := 0; i < 10; i++ {
+		fw.Write([]byte("foo"))
+	}
+	if cf.flushes != 2 {
+		t.Errorf("MaxBytes=10: got %d flushes, expected 2", cf.flushes)
+	}
+
+	cf = &countingFlusher{ResponseWriter: httptest.NewRecorder()}
+	fw = &FlushyResponseWriter{ResponseWriter: cf, MaxBytes: 1000, MaxDelay: 10 * time.Millisecond}
+	fw.Write([]byte("foo"))
+	time.Sleep(20 * time.Millisecond)
+	fw.Write([]byte("bar"))
+	if cf.flushes != 1 {
+		t.Errorf("MaxDelay=10ms: got %d flushes, expected 1", cf.flushes)
+	}
+}
+
+func TestWriteToFlushesWhenCaughtUp(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("", &Config{
+		SourceBuffer: 5,
+		FrameBytes:   3,
+		CloseIdle:    true,
+		Reopen:       false,
+		ExecFlag:     true,
+		Args:         []string{"sh", "-c", "echo -n foo; sleep .1; echo -n bar; sleep .1"},
+	})
+	defer rdr.Close()
+	rec := httptest.NewRecorder()
+	cf := &countingFlusher{ResponseWriter: rec}
+	fw := &FlushyResponseWriter{ResponseWriter: cf, MaxBytes: 1000, MaxDelay: time.Hour}
+	if _, err := io.Copy(fw, rdr); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "foobar" {
+		t.Errorf("got %q", rec.Body.String())
+	}
+	if cf.flushes != 2 {
+		t.Errorf("got %d flushes, expected 2", cf.flushes)
+	}
+}
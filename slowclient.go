@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Slow client policies: what to do when a client falls behind.
+const (
+	// Skip frames to catch up with the source.
+	policySkip = "skip"
+	// Skip frames, but disconnect the client after it has
+	// skipped more than slowMaxSkips frames.
+	policyDisconnectAfterSkips = "disconnect-after-skips"
+	// Disconnect the client when the next frame it would receive
+	// was published more than slowMaxLag ago, or when it would
+	// otherwise have to skip frames.
+	policyDisconnectOnLag = "disconnect-on-lag"
+	// Keep frames the client hasn't read yet after they leave the
+	// ring buffer, up to slowQueue frames. Disconnect the client
+	// if that isn't enough.
+	policyQueue = "queue"
+)
+
+var slowClientPolicies = []string{policySkip, policyDisconnectAfterSkips, policyDisconnectOnLag, policyQueue}
+
+// A SlowClientError is returned by SourceReader.Read when the
+// source's slow client policy disconnects the client.
+type SlowClientError struct {
+	Policy string
+	Detail string
+}
+
+func (e *SlowClientError) Error() string {
+	return fmt.Sprintf("slow client policy %s: %s", e.Policy, e.Detail)
+}
+
+// slowClientTrailer is the HTTP trailer that names the policy that
+// disconnected a client (if any).
+const slowClientTrailer = "Streamserve-Slow-Client-Policy"
+
+// setSlowPolicy copies the slow client policy settings from c. The
+// caller must hold s.Lock(), or be NewSource.
+func (s *Source) setSlowPolicy(c *Config) {
+	s.slowPolicy = c.SlowClientPolicy
+	if s.slowPolicy == "" {
+		s.slowPolicy = policySkip
+	}
+	s.slowMaxSkips = c.SlowClientMaxSkips
+	s.slowMaxLag = c.SlowClientMaxLag
+	s.slowQueue = int(c.SlowClientQueue)
+}
+
+// enqueueEvicted is called when f is about to be released by the
+// ring buffer. If the source's policy is "queue", it keeps a
+// reference to f for each reader that hasn't read it yet.
+func (s *Source) enqueueEvicted(f *frame) {
+	if s.slowPolicy != policyQueue {
+		return
+	}
+	s.readersLock.Lock()
+	defer s.readersLock.Unlock()
+	for sr := range s.readers {
+		sr.enqueue(f, s.slowQueue)
+	}
+}
+
+// enqueue adds f to the reader's queue, if the reader has started
+// reading and hasn't reached f yet.
+func (sr *SourceReader) enqueue(f *frame, max int) {
+	sr.queueLock.Lock()
+	defer sr.queueLock.Unlock()
+	next := atomic.LoadUint64(&sr.nextFrame)
+	if sr.queueFull || next == 0 || next > f.seq {
+		return
+	}
+	if len(sr.queue) >= max {
+		sr.queueFull = true
+		return
+	}
+	if f.acquire() {
+		sr.queue = append(sr.queue, f)
+	}
+}
+
+// nextQueued returns the next frame from the reader's queue, or nil
+// if the queue is empty.
+func (sr *SourceReader) nextQueued() (*frame, error) {
+	sr.queueLock.Lock()
+	defer sr.queueLock.Unlock()
+	if sr.queueFull {
+		return nil, &SlowClientError{
+			Policy: policyQueue,
+			Detail: fmt.Sprintf("fell behind by more than %d queued frames", sr.source.slowQueue),
+		}
+	}
+	for len(sr.queue) > 0 {
+		f := sr.queue[0]
+		sr.queue[0] = nil
+		sr.queue = sr.queue[1:]
+		if f.seq >= sr.nextFrame {
+			return f, nil
+		}
+		f.release()
+	}
+	return nil, nil
+}
+
+// requeue puts f (which the caller has a reference to, and hasn't
+// delivered) back at the front of the reader's queue, if it is no
+// longer in the ring buffer. It returns false if f is still in the
+// ring, or the source's policy isn't "queue".
+func (sr *SourceReader) requeue(f *frame) bool {
+	if sr.source.slowPolicy != policyQueue {
+		return false
+	}
+	if rf := sr.source.ring.get(f.seq); rf != nil {
+		rf.release()
+		return false
+	}
+	sr.queueLock.Lock()
+	defer sr.queueLock.Unlock()
+	f.acquire()
+	sr.queue = append([]*frame{f}, sr.queue...)
+	return true
+}
+
+// releaseQueue drops the reader's queued frames.
+func (sr *SourceReader) releaseQueue() {
+	sr.queueLock.Lock()
+	defer sr.queueLock.Unlock()
+	for _, f := range sr.queue {
+		f.release()
+	}
+	sr.queue = nil
+}
+
+// checkSkip returns an error if the source's policy doesn't allow
+// the reader to skip delta frames.
+func (sr *SourceReader) checkSkip(delta uint64) error {
+	s := sr.source
+	switch s.slowPolicy {
+	case policyDisconnectAfterSkips:
+		if sr.FramesSkipped+delta > s.slowMaxSkips {
+			return &SlowClientError{
+				Policy: s.slowPolicy,
+				Detail: fmt.Sprintf("would skip %d frames, limit is %d", sr.FramesSkipped+delta, s.slowMaxSkips),
+			}
+		}
+	case policyDisconnectOnLag:
+		return &SlowClientError{
+			Policy: s.slowPolicy,
+			Detail: fmt.Sprintf("fell behind by more than %d frames", s.ring.Len()),
+		}
+	}
+	return nil
+}
+
+// checkLag returns an error if the source's policy doesn't allow the
+// reader to receive f, because f is too old.
+func (sr *SourceReader) checkLag(f *frame) error {
+	s := sr.source
+	if s.slowPolicy != policyDisconnectOnLag || s.slowMaxLag <= 0 {
+		return nil
+	}
+	if lag := time.Since(f.published); lag > s.slowMaxLag {
+		return &SlowClientError{
+			Policy: s.slowPolicy,
+			Detail: fmt.Sprintf("lagging %v behind source, limit is %v", lag.Round(time.Millisecond), s.slowMaxLag),
+		}
+	}
+	return nil
+}
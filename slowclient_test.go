@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// slowReader returns a reader for a source that produces 1000
+// 16-byte frames per second, after reading one frame and then
+// sleeping for the given time.
+func slowReader(t *testing.T, c Config, sleep time.Duration) (*SourceMap, *SourceReader) {
+	c.FrameBytes = 16
+	c.SourceBandwidth = 16000
+	c.CloseIdle = true
+	sm := NewSourceMap()
+	rdr := sm.NewReader("/dev/zero", &c)
+	if _, err := rdr.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(sleep)
+	return sm, rdr
+}
+
+// readErr reads n frames, and returns the first error.
+func readErr(rdr *SourceReader, n int) error {
+	buf := make([]byte, 16)
+	for i := 0; i < n; i++ {
+		if _, err := rdr.Read(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectPolicyError(t *testing.T, err error, policy string) {
+	if e, ok := err.(*SlowClientError); !ok {
+		t.Errorf("expected SlowClientError, got %v", err)
+	} else if e.Policy != policy {
+		t.Errorf("expected policy %q, got %q (%s)", policy, e.Policy, e)
+	}
+}
+
+func TestSlowClientSkip(t *testing.T) {
+	sm, rdr := slowReader(t, Config{SourceBuffer: 5}, 100*time.Millisecond)
+	defer sm.Close()
+	defer rdr.Close()
+	if err := readErr(rdr, 10); err != nil {
+		t.Error(err)
+	}
+	if rdr.FramesSkipped == 0 {
+		t.Error("expected skipped frames")
+	}
+}
+
+func TestSlowClientDisconnectAfterSkips(t *testing.T) {
+	sm, rdr := slowReader(t, Config{
+		SourceBuffer:       5,
+		SlowClientPolicy:   policyDisconnectAfterSkips,
+		SlowClientMaxSkips: 10,
+	}, 100*time.Millisecond)
+	defer sm.Close()
+	defer rdr.Close()
+	expectPolicyError(t, readErr(rdr, 10), policyDisconnectAfterSkips)
+
+	sm2, rdr2 := slowReader(t, Config{
+		SourceBuffer:       5,
+		SlowClientPolicy:   policyDisconnectAfterSkips,
+		SlowClientMaxSkips: 100000,
+	}, 100*time.Millisecond)
+	defer sm2.Close()
+	defer rdr2.Close()
+	if err := readErr(rdr2, 10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSlowClientDisconnectOnLag(t *testing.T) {
+	sm, rdr := slowReader(t, Config{
+		SourceBuffer:     5000,
+		SlowClientPolicy: policyDisconnectOnLag,
+		SlowClientMaxLag: 50 * time.Millisecond,
+	}, 200*time.Millisecond)
+	defer sm.Close()
+	defer rdr.Close()
+	expectPolicyError(t, readErr(rdr, 1), policyDisconnectOnLag)
+
+	// Falling behind by more than the buffer also disconnects,
+	// even if max lag is not reached.
+	sm2, rdr2 := slowReader(t, Config{
+		SourceBuffer:     5,
+		SlowClientPolicy: policyDisconnectOnLag,
+		SlowClientMaxLag: time.Hour,
+	}, 100*time.Millisecond)
+	defer sm2.Close()
+	defer rdr2.Close()
+	expectPolicyError(t, readErr(rdr2, 10), policyDisconnectOnLag)
+}
+
+func TestSlowClientQueue(t *testing.T) {
+	sm, rdr := slowReader(t, Config{
+		SourceBuffer:     5,
+		SlowClientPolicy: policyQueue,
+		SlowClientQueue:  1000,
+	}, 100*time.Millisecond)
+	defer sm.Close()
+	defer rdr.Close()
+	if err := readErr(rdr, 200); err != nil {
+		t.Error(err)
+	}
+	if rdr.FramesSkipped != 0 {
+		t.Errorf("skipped %d frames, expected none", rdr.FramesSkipped)
+	}
+
+	sm2, rdr2 := slowReader(t, Config{
+		SourceBuffer:     5,
+		SlowClientPolicy: policyQueue,
+		SlowClientQueue:  10,
+	}, 100*time.Millisecond)
+	defer sm2.Close()
+	defer rdr2.Close()
+	expectPolicyError(t, readErr(rdr2, 10), policyQueue)
+}
@@ -6,60 +6,101 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"os/exec"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var ErrInputClosed = errors.New("Input is closed")
 
 type Source struct {
-	label            string
-	sinkCount        uint64
-	todo             []byte
-	frames           [][]byte
-	frameLocks       []sync.RWMutex
-	frameBytes       uint64
-	gone             bool
-	header           []byte
-	HeaderBytes      uint64
-	input            io.ReadCloser
-	inputLock        sync.Mutex
-	nextFrame        uint64 // How many frames have ever been here
-	execArgs         []string
-	cmd              *exec.Cmd
-	path             string
-	closeIdle        bool
-	reopen           bool
-	bandwidth        uint64
-	clientMaxBytes   uint64
-	filter           FilterFunc
-	filterContext    interface{}
-	sync.RWMutex     // Must be held while changing nextFrame or gone
-	*sync.Cond       // Control access to frames other than nextFrame
-	statBytesInvalid uint64
-	statBytesIn      uint64
-	statBytesOut     uint64
-	startTime        time.Time // source became available to clients
-	openTime         time.Time // current reader fd opened / process started
-	statLogInterval  time.Duration
-	maxQuietInterval time.Duration
-	sourceMap        *SourceMap
+	label                 string
+	sinkCount             uint64
+	todo                  []byte
+	ring                  *ring
+	frameBytes            uint64
+	gone                  bool
+	stopping              bool // readers should stop at the next frame boundary
+	header                []byte
+	HeaderBytes           uint64
+	input                 io.ReadCloser
+	inputLock             sync.Mutex
+	nextFrame             uint64        // How many frames have ever been here
+	inputs                []sourceInput // primary input, then -fallback inputs
+	current               int           // index of input in use (guarded by inputLock)
+	recovered             *openedInput  // primary input reopened by probePrimary
+	probing               bool          // probePrimary is running
+	fallbackRetry         time.Duration
+	statFailovers         uint64
+	cmd                   *exec.Cmd
+	key                   string // sourceMap key
+	closeIdle             bool
+	reopen                bool
+	forceReopen           int32 // reopen once, even if !reopen (see Reopen)
+	bandwidth             uint64
+	clientMaxBytes        uint64
+	filter                FilterFunc
+	filterContext         interface{}
+	duration              DurationFunc // nil if frame durations are unknown
+	realtime              bool         // pace input by frame durations
+	lastDuration          time.Duration
+	filterName            string
+	filler                string // see -filler
+	fillerPath            string // -filler file that was split into fillerFrames
+	fillerFrames          [][]byte
+	stopFiller            func() // stops the filler, if it's running
+	statFillerFrames      uint64
+	skipBytes             uint64 // rest of a tag to discard (see SkipError)
+	statBytesTags         uint64
+	statFramesRejected    uint64
+	restart               restartPolicy
+	restartFailures       []time.Time // recent consecutive failures
+	restartCount          int         // consecutive failures
+	failed                int32       // see isFailed
+	delivered             bool        // current input has supplied a frame
+	statRestartFailures   uint64
+	done                  chan struct{} // closed by disconnectAll
+	doneOnce              sync.Once
+	tagMetadata           bool // see -tag-metadata
+	metadata              atomic.Pointer[Metadata]
+	sync.RWMutex          // Must be held while changing nextFrame or gone
+	*sync.Cond            // Wait for nextFrame to advance
+	statBytesInvalid      uint64
+	statBytesIn           uint64
+	statBytesOut          uint64
+	statReopens           uint64
+	statKills             uint64
+	statQuietKills        uint64
+	statClientSkipped     *histogram
+	statClientSeconds     *histogram
+	startTime             time.Time // source became available to clients
+	openTime              time.Time // current reader fd opened / process started
+	statLogInterval       time.Duration
+	clientStatLogInterval time.Duration
+	maxQuietInterval      time.Duration
+	childKillDelay        time.Duration
+	sourceMap             *SourceMap
+	readers               map[*SourceReader]bool
+	readersLock           sync.Mutex
+	pending               *Config // config to use at next reopen
+	successor             *Source // replaced this source after reconfiguration
+	pool                  atomic.Pointer[writerPool]
+	slowPolicy            string // see slowClientPolicies
+	slowMaxSkips          uint64
+	slowMaxLag            time.Duration
+	slowQueue             int
 }
 
 func NewSource(path string, c *Config, sourceMap *SourceMap) (s *Source) {
 	s = &Source{}
 	s.startTime = time.Now()
-	s.path = path
+	s.key = path
 	s.sourceMap = sourceMap
 	s.Cond = sync.NewCond(s.RLocker())
-	s.frameLocks = make([]sync.RWMutex, c.SourceBuffer)
-	s.frames = make([][]byte, c.SourceBuffer)
-	for i := range s.frames {
-		s.frames[i] = make([]byte, c.FrameBytes)
-	}
+	s.ring = newRing(c.SourceBuffer, c.FrameBytes)
+	s.ring.evicted = s.enqueueEvicted
 	s.todo = make([]byte, 0, c.FrameBytes)
 	s.bandwidth = c.SourceBandwidth
 	s.clientMaxBytes = c.ClientMaxBytes
@@ -68,60 +109,62 @@ func NewSource(path string, c *Config, sourceMap *SourceMap) (s *Source) {
 	s.HeaderBytes = c.HeaderBytes
 	s.reopen = c.Reopen
 	s.statLogInterval = c.StatLogInterval
+	s.clientStatLogInterval = c.ClientStatLogInterval
+	s.readers = make(map[*SourceReader]bool)
 	s.maxQuietInterval = c.MaxQuietInterval
-	s.filter = Filters[c.FrameFilter]
-	if c.ExecFlag {
-		s.label = fmt.Sprintf("%v", c.Args)
-		s.execArgs = c.Args
-	} else {
-		s.label = path
+	s.childKillDelay = c.ChildKillDelay
+	s.fallbackRetry = c.FallbackRetry
+	s.setSlowPolicy(c)
+	s.filter = c.filterFunc()
+	s.duration = c.durationFunc()
+	s.realtime = c.Realtime
+	s.filterName = c.FrameFilter
+	s.filler = c.Filler
+	s.tagMetadata = c.TagMetadata
+	s.restart = c.restartPolicy()
+	s.done = make(chan struct{})
+	s.statClientSkipped = newClientSkippedHistogram()
+	s.statClientSeconds = newClientSecondsHistogram()
+	primary := sourceInput{label: path, path: path}
+	if c.Playlist != "" {
+		primary = sourceInput{label: c.Playlist, playlist: c.Playlist}
+	} else if c.ExecFlag {
+		primary = sourceInput{label: fmt.Sprintf("%v", c.Args), execArgs: c.Args}
+	} else if c.Name != "" {
+		// Mounted from a config file: path is the URI path,
+		// not the source fifo.
+		primary = sourceInput{label: c.Path, path: c.Path}
 	}
-	return
-}
-
-func (s *Source) openInputFile() (err error) {
-	s.inputLock.Lock()
-	defer s.inputLock.Unlock()
-	s.input, err = os.Open(s.path)
-	if err != nil {
-		return
+	s.label = primary.label
+	if c.Name != "" {
+		s.label = c.Name
 	}
-	s.openTime = time.Now()
-	log.Println("source", s.label, "opened")
-	return
-}
-
-func (s *Source) openInputCmd() (err error) {
-	s.inputLock.Lock()
-	defer s.inputLock.Unlock()
-	s.cmd = exec.Command(s.execArgs[0], s.execArgs[1:]...)
-	s.input, err = s.cmd.StdoutPipe()
-	if err != nil {
-		s.cmd = nil
-		return
+	s.inputs = []sourceInput{primary}
+	for _, spec := range c.Fallbacks {
+		s.inputs = append(s.inputs, parseFallback(spec))
 	}
-	err = s.cmd.Start()
-	if err != nil {
-		s.input = nil
-		s.cmd = nil
+	eo := c.execOptions(s.label)
+	for i := range s.inputs {
+		s.inputs[i].shuffle = c.Shuffle
+		s.inputs[i].exec = eo
 	}
-	s.openTime = time.Now()
-	log.Println("source", s.label, "opened, pid", s.cmd.Process.Pid)
 	return
 }
 
-func (s *Source) openInput() (err error) {
+// openInput opens s.inputs[idx] and reads its header.
+func (s *Source) openInput(idx int) (err error) {
 	// Notify anyone waiting for the header to arrive
 	defer s.Cond.Broadcast()
-	if len(s.execArgs) > 0 {
-		err = s.openInputCmd()
-	} else {
-		err = s.openInputFile()
-	}
+	in := &s.inputs[idx]
+	rc, cmd, err := in.open()
 	if err != nil {
-		log.Printf("source %s open: %s", s.label, err)
+		log.Printf("source %s open %s: %s", s.label, in.label, err)
 		return
 	}
+	// Attach the input before reading the header, so
+	// closeInput can interrupt the read, but don't switch to it
+	// until the header is accepted.
+	s.attachInput(idx, &openedInput{input: rc, cmd: cmd})
 	header := make([]byte, s.HeaderBytes)
 	for pos := uint64(0); pos < s.HeaderBytes; {
 		var got int
@@ -130,6 +173,9 @@ func (s *Source) openInput() (err error) {
 			return ErrInputClosed
 		}
 		if got, err = in.Read(header[pos:]); got == 0 {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
 			log.Printf("source %s read-header: %s", s.label, err)
 			s.closeInput()
 			return
@@ -137,17 +183,61 @@ func (s *Source) openInput() (err error) {
 		pos += uint64(got)
 	}
 	if len(s.header) > 0 && bytes.Compare(header, s.header) != 0 {
-		log.Printf("header mismatch: old %v, new %v", s.header, header)
+		log.Printf("source %s %s header mismatch: old %v, new %v", s.label, s.inputs[idx].label, s.header, header)
 		s.closeInput()
-		return
+		return ErrHeaderMismatch
 	}
 	s.Cond.L.Lock()
 	s.header = header
 	s.Cond.L.Unlock()
 	s.statBytesIn += s.HeaderBytes
+	s.switchInput(idx)
 	return
 }
 
+// useInput starts reading from oi, which is an opened s.inputs[idx]
+// whose header (if any) has already been checked.
+func (s *Source) useInput(idx int, oi *openedInput) {
+	s.attachInput(idx, oi)
+	s.switchInput(idx)
+}
+
+// attachInput makes oi, which is an opened s.inputs[idx], the
+// source's input.
+func (s *Source) attachInput(idx int, oi *openedInput) {
+	s.inputLock.Lock()
+	defer s.inputLock.Unlock()
+	s.skipBytes = 0
+	s.delivered = false
+	s.input = oi.input
+	s.cmd = oi.cmd
+	s.openTime = time.Now()
+	if oi.cmd != nil {
+		log.Println("source", s.label, "opened", s.inputs[idx].label, "pid", oi.cmd.Process.Pid)
+	} else {
+		log.Println("source", s.label, "opened", s.inputs[idx].label)
+	}
+}
+
+// switchInput records that the source is reading from s.inputs[idx],
+// after attachInput. When switching to a different input, partial
+// frames from the previous input are discarded.
+func (s *Source) switchInput(idx int) {
+	s.inputLock.Lock()
+	defer s.inputLock.Unlock()
+	if idx != s.current {
+		log.Printf("source %s switching from %s to %s", s.label, s.inputs[s.current].label, s.inputs[idx].label)
+		atomic.AddUint64(&s.statFailovers, 1)
+		s.todo = s.todo[:0]
+		s.filterContext = nil
+	}
+	s.current = idx
+	if idx > 0 && !s.probing {
+		s.probing = true
+		go s.probePrimary()
+	}
+}
+
 func (s *Source) closeInput() {
 	s.inputLock.Lock()
 	if s.input != nil {
@@ -158,39 +248,83 @@ func (s *Source) closeInput() {
 	}
 	if s.cmd != nil {
 		if s.cmd.Process != nil {
-			log.Println("source", s.label, "kill", s.cmd.Process.Pid)
-			s.cmd.Process.Kill()
+			s.stopCmd()
+		} else {
+			s.cmd.Wait()
 		}
-		s.cmd.Wait()
 		s.cmd = nil
 	}
 	s.inputLock.Unlock()
 }
 
+// stopCmd sends SIGTERM to the child process, and, if it doesn't
+// exit within s.childKillDelay, SIGKILL. It returns after the process
+// exits. The caller must hold inputLock.
+func (s *Source) stopCmd() {
+	pid := s.cmd.Process.Pid
+	exited := make(chan error, 1)
+	go func() { exited <- s.cmd.Wait() }()
+	atomic.AddUint64(&s.statKills, 1)
+	if s.childKillDelay > 0 {
+		log.Println("source", s.label, "terminate", pid)
+		signalCmd(s.cmd, syscall.SIGTERM)
+		select {
+		case <-exited:
+			return
+		case <-time.After(s.childKillDelay):
+		}
+	}
+	log.Println("source", s.label, "kill", pid)
+	signalCmd(s.cmd, syscall.SIGKILL)
+	<-exited
+}
+
 func (s *Source) readNextFrame() (okFrameSize int, err error) {
-	bufPos := s.nextFrame % uint64(cap(s.frames))
-	s.frameLocks[bufPos].Lock()
-	defer s.frameLocks[bufPos].Unlock()
-	s.frames[bufPos] = s.frames[bufPos][:cap(s.frames[bufPos])]
+	// Fill a spare frame, and publish it in the ring when it's
+	// complete. Readers can still use the frame it replaces.
+	f := s.ring.newFrame()
+	buf := f.data
+	defer func() {
+		if err == nil {
+			s.endFiller()
+			if s.duration != nil {
+				f.duration = s.duration(f.data)
+			}
+			s.lastDuration = f.duration
+			s.ring.publish(f, s.nextFrame)
+		} else {
+			f.pool.Put(f)
+		}
+	}()
 	for frameEnd := 0; frameEnd < int(s.frameBytes); {
 		in := s.input
 		if s.gone {
 			// Stop without using up todo.
 			return 0, io.EOF
 		} else if len(s.todo) > 0 {
-			copy(s.frames[bufPos][frameEnd:], s.todo)
+			copy(buf[frameEnd:], s.todo)
 			frameEnd += len(s.todo)
 			s.todo = s.todo[:0]
 		} else if in == nil {
 			// Stop after using up todo.
 			return 0, io.EOF
 		} else {
-			got, err := in.Read(s.frames[bufPos][frameEnd:])
+			got, err := in.Read(buf[frameEnd:])
 			if s.gone {
 				return 0, io.EOF
 			} else if got > 0 {
-				frameEnd += got
 				s.statBytesIn += uint64(got)
+				if s.skipBytes > 0 {
+					// Discard the rest of a tag.
+					n := got
+					if uint64(n) > s.skipBytes {
+						n = int(s.skipBytes)
+					}
+					copy(buf[frameEnd:], buf[frameEnd+n:frameEnd+got])
+					got -= n
+					s.skipBytes -= uint64(n)
+				}
+				frameEnd += got
 			} else if err != nil {
 				return 0, err
 			} else {
@@ -203,26 +337,43 @@ func (s *Source) readNextFrame() (okFrameSize int, err error) {
 		}
 		frameStart := 0
 		for err != ErrShortFrame && frameStart < frameEnd {
-			okFrameSize, s.filterContext, err = s.filter(s.frames[bufPos][frameStart:frameEnd], s.filterContext)
+			okFrameSize, s.filterContext, err = s.filter(buf[frameStart:frameEnd], s.filterContext)
+			if skip, ok := err.(*SkipError); ok {
+				n := frameEnd - frameStart
+				if n > skip.Bytes {
+					n = skip.Bytes
+				}
+				frameStart += n
+				s.skipBytes = uint64(skip.Bytes - n)
+				atomic.AddUint64(&s.statBytesTags, uint64(skip.Bytes))
+				s.setMetadata(skip.Meta)
+				err = nil
+				continue
+			}
 			switch err {
 			case nil:
 				s.todo = s.todo[:frameEnd-okFrameSize-frameStart]
-				copy(s.todo, s.frames[bufPos][frameStart+okFrameSize:frameEnd])
+				copy(s.todo, buf[frameStart+okFrameSize:frameEnd])
 				if frameStart > 0 {
-					copy(s.frames[bufPos], s.frames[bufPos][frameStart:frameStart+okFrameSize])
+					copy(buf, buf[frameStart:frameStart+okFrameSize])
 				}
-				s.frames[bufPos] = s.frames[bufPos][:okFrameSize]
+				f.data = buf[:okFrameSize]
 				return
 			case ErrInvalidFrame:
 				// Try filter again on next byte
 				frameStart++
-				s.statBytesInvalid++
+				atomic.AddUint64(&s.statBytesInvalid, 1)
+				err = nil
+			case ErrRejectedFrame:
+				frameStart++
+				atomic.AddUint64(&s.statBytesInvalid, 1)
+				atomic.AddUint64(&s.statFramesRejected, 1)
 				err = nil
 			default:
 			}
 		}
 		// Shuffle the remaining bytes over and get more data
-		copy(s.frames[bufPos], s.frames[bufPos][frameStart:frameEnd])
+		copy(buf, buf[frameStart:frameEnd])
 		frameEnd -= frameStart
 		frameStart = 0
 		err = nil
@@ -238,21 +389,41 @@ func (s *Source) run() {
 	var err error
 	defer s.LogStats()
 	defer s.Close()
-	if err := s.openInput(); err != nil {
+	if err := s.openFirst(0, len(s.inputs)); err != nil {
 		return
 	}
 	defer s.closeInput()
+	defer s.endFiller()
+	defer func() {
+		if oi := s.takeRecovered(); oi != nil {
+			s.closeOpened(oi)
+		}
+	}()
 	var ticker *time.Ticker
-	if s.bandwidth > 0 {
-		ticker = time.NewTicker(time.Duration(uint64(time.Second) * s.frameBytes / s.bandwidth))
-	}
-	var toThrottle int // #bytes read from source but not yet throttled by ticker
+	var tickerBandwidth uint64 // s.bandwidth when ticker was set up
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	var openFailed bool  // last reopen attempt failed
+	var toThrottle int   // #bytes read from source but not yet throttled by ticker
+	paceAt := time.Now() // when the next frame is due, with -realtime
 	if s.statLogInterval > 0 {
 		ticker := time.NewTicker(s.statLogInterval)
 		defer ticker.Stop()
 		go func() {
 			for range ticker.C {
-				s.LogStats()
+				s.logSourceStats()
+			}
+		}()
+	}
+	if s.clientStatLogInterval > 0 {
+		ticker := time.NewTicker(s.clientStatLogInterval)
+		defer ticker.Stop()
+		go func() {
+			for range ticker.C {
+				s.logClientStats(true)
 			}
 		}()
 	}
@@ -265,6 +436,7 @@ func (s *Source) run() {
 			for t := range ticker.C {
 				if lastcount == s.statBytesIn {
 					log.Printf("source %s stuck at %d bytes for %v (since %v)", s.label, lastcount, t.Sub(lasttime), lasttime)
+					atomic.AddUint64(&s.statQuietKills, 1)
 					s.closeInput()
 				} else {
 					lastcount = s.statBytesIn
@@ -280,19 +452,73 @@ func (s *Source) run() {
 				log.Printf("source %s read: %s", s.label, err)
 				s.closeInput()
 			}
-			if s.gone || !s.reopen {
+			if s.gone {
+				break
+			} else if oi := s.takeRecovered(); oi != nil {
+				// Switch back to the primary input
+				s.useInput(0, oi)
+				continue
+			} else if !(s.reopen || s.reopenForced() || s.current+1 < len(s.inputs)) {
 				// Shouldn't reopen
 				break
-			} else if err = s.openInput(); err != nil {
+			} else if pending := s.pendingConfig(); pending != nil {
+				// Reopen with a new ring buffer
+				s.replace(pending)
+				break
+			}
+			if s.stopFiller == nil {
+				s.stopFiller = s.startFiller()
+			}
+			if !s.reopenForced() && !s.waitRestart(openFailed || !s.delivered) {
+				break
+			}
+			if err = s.failover(); err != nil {
+				if s.reopen && !s.gone {
+					// Keep trying, with backoff
+					log.Printf("source %s reopen: %s", s.label, err)
+					openFailed = true
+					continue
+				}
 				// Failed reopen
 				break
-			} else {
-				// Successful reopen
-				continue
 			}
+			openFailed = false
+			// Successful reopen
+			atomic.StoreInt32(&s.forceReopen, 0)
+			atomic.AddUint64(&s.statReopens, 1)
+			continue
+		}
+		atomic.AddUint64(&s.nextFrame, 1)
+		if !s.delivered {
+			s.delivered = true
+			s.checkRecovered()
 		}
-		s.nextFrame++
 		s.Cond.Broadcast()
+		s.wakePool()
+		if bw := s.bandwidth; bw != tickerBandwidth {
+			// Bandwidth was set by NewSource, or changed
+			// by a config reload.
+			if ticker != nil {
+				ticker.Stop()
+				ticker = nil
+			}
+			if bw > 0 {
+				ticker = time.NewTicker(time.Duration(uint64(time.Second) * s.frameBytes / bw))
+			}
+			tickerBandwidth = bw
+			toThrottle = 0
+		}
+		if s.realtime || s.inputs[s.current].playlist != "" {
+			paceAt = paceAt.Add(s.lastDuration)
+			if wait := time.Until(paceAt); wait > 0 {
+				time.Sleep(wait)
+			} else if wait < -time.Second {
+				// The input has fallen behind (e.g., while
+				// reopening). Don't send a burst of frames
+				// to catch up.
+				paceAt = time.Now()
+			}
+		}
 		if ticker != nil {
 			toThrottle += frameSize
 			for toThrottle >= int(s.frameBytes) {
@@ -303,14 +529,34 @@ func (s *Source) run() {
 	}
 }
 
-// LogStats logs data source and client statistics (bytes in, skipped, out).
+// LogStats logs data source statistics (bytes in, skipped, out),
+// followed by statistics for each connected client.
 func (s *Source) LogStats() {
-	log.Printf("source %s stats: %d activeclients, %d inbytes, %d invalidbytes, %d outbytes, %v uptime", s.label, s.sinkCount, s.statBytesIn, s.statBytesInvalid, s.statBytesOut, time.Since(s.startTime))
+	s.logSourceStats()
+	s.logClientStats(false)
+}
+
+func (s *Source) logSourceStats() {
+	log.Printf("source %s stats: %d activeclients, %d inbytes, %d invalidbytes, %d rejectedframes, %d outbytes, %v uptime", s.label, s.sinkCount, s.statBytesIn, atomic.LoadUint64(&s.statBytesInvalid), atomic.LoadUint64(&s.statFramesRejected), s.statBytesOut, time.Since(s.startTime))
 }
 
 func (s *Source) GetHeader(buf []byte) (int, error) {
+	header, err := s.getHeader()
+	if err != nil || header == nil {
+		return 0, err
+	}
+	if len(buf) < len(header) {
+		return 0, ErrBufferTooSmall
+	}
+	atomic.AddUint64(&s.statBytesOut, s.HeaderBytes)
+	return copy(buf, header), nil
+}
+
+// getHeader waits for the source's header to arrive, and returns it.
+// The returned slice must not be modified.
+func (s *Source) getHeader() ([]byte, error) {
 	if s.HeaderBytes == 0 {
-		return 0, nil
+		return nil, nil
 	}
 	s.Cond.L.Lock()
 	defer s.Cond.L.Unlock()
@@ -318,28 +564,51 @@ func (s *Source) GetHeader(buf []byte) (int, error) {
 		s.Cond.Wait()
 	}
 	if uint64(len(s.header)) < s.HeaderBytes {
-		return 0, io.EOF
+		return nil, io.EOF
 	}
-	if len(buf) < len(s.header) {
-		return 0, ErrBufferTooSmall
+	return s.header, nil
+}
+
+// logClientStats logs statistics for each connected client,
+// including the number of frames skipped since the last periodic
+// log (see -client-stats-log-interval).
+func (s *Source) logClientStats(periodic bool) {
+	s.readersLock.Lock()
+	defer s.readersLock.Unlock()
+	for sr := range s.readers {
+		sr.logStats(periodic)
 	}
-	atomic.AddUint64(&s.statBytesOut, s.HeaderBytes)
-	copy(buf, s.header)
-	return int(s.HeaderBytes), nil
 }
 
-// NewReader returns a SourceReader that reads frames from this source.
-func (s *Source) NewReader() *SourceReader {
+// NewReader returns a SourceReader that reads frames from this
+// source. The client label identifies the reader in log messages.
+func (s *Source) NewReader(client string) *SourceReader {
+	sr := &SourceReader{
+		ID:        atomic.AddUint64(&lastClientID, 1),
+		source:    s,
+		client:    client,
+		startTime: time.Now(),
+	}
+	s.addReader(sr)
+	return sr
+}
+
+func (s *Source) addReader(sr *SourceReader) {
+	s.readersLock.Lock()
+	s.readers[sr] = true
+	s.readersLock.Unlock()
 	atomic.AddUint64(&s.sinkCount, 1)
-	s.LogStats()
-	return &SourceReader{source: s}
+	s.logSourceStats()
 }
 
 // Done is called by each SourceReader when it stops reading, so the
 // Source can know whether it is idle.
-func (s *Source) Done() {
+func (s *Source) Done(sr *SourceReader) {
+	s.readersLock.Lock()
+	delete(s.readers, sr)
+	s.readersLock.Unlock()
 	atomic.AddUint64(&s.sinkCount, ^uint64(0))
-	s.LogStats()
+	s.logSourceStats()
 	if s.closeIdle {
 		s.closeIfIdle()
 	}
@@ -348,21 +617,41 @@ func (s *Source) Done() {
 // Make sure everyone waiting in Next() gives up. Prevents deadlock.
 func (s *Source) disconnectAll() {
 	s.gone = true
+	if s.done != nil {
+		s.doneOnce.Do(func() { close(s.done) })
+	}
+	s.Broadcast()
+}
+
+// Stop makes each reader stop (return EOF) when it has finished
+// reading its current frame, without waiting for the rest of the
+// buffer.
+func (s *Source) Stop() {
+	s.Lock()
+	s.stopping = true
+	s.Unlock()
 	s.Broadcast()
+	s.wakePool()
 }
 
 // Close disconnects all clients and closes the source.
 func (s *Source) Close() {
 	s.closeIdle = true
 	s.disconnectAll()
+	if p := s.pool.Load(); p != nil {
+		p.close()
+	}
 	s.closeInput()
 }
 
 func (s *Source) closeIfIdle() {
 	didClose := false
 	s.sourceMap.mutex.Lock()
-	if s.sinkCount == 0 {
-		delete(s.sourceMap.sources, s.path)
+	if s.sinkCount == 0 && !s.isFailed() {
+		if s.sourceMap.sources[s.key] == s {
+			delete(s.sourceMap.sources, s.key)
+			s.sourceMap.retire(s)
+		}
 		didClose = true
 	}
 	s.sourceMap.mutex.Unlock()
@@ -372,12 +661,18 @@ func (s *Source) closeIfIdle() {
 }
 
 type SourceMap struct {
-	sources map[string]*Source
-	mutex   sync.RWMutex
+	sources   map[string]*Source
+	mutex     sync.RWMutex
+	pools     map[*writerPool]bool // running writer pools
+	poolsLock sync.Mutex
+	pooled    sync.WaitGroup // clients served by writer pools
+	stopping  bool           // Stop was called
+	// Counters of closed sources, by label (see WriteMetrics)
+	totals map[string]*sourceTotals
 }
 
 func NewSourceMap() (sm *SourceMap) {
-	sm = &SourceMap{sources: make(map[string]*Source)}
+	sm = &SourceMap{sources: make(map[string]*Source), totals: make(map[string]*sourceTotals)}
 	return
 }
 
@@ -393,18 +688,36 @@ func (sm *SourceMap) Close() {
 	}
 }
 
+// Stop stops all readers of all sources at their next frame
+// boundary. Sources created after Stop are stopped too.
+func (sm *SourceMap) Stop() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.stopping = true
+	for _, src := range sm.sources {
+		src.Stop()
+	}
+}
+
 // NewReader returns a SourceReader for the given path (URI) and
 // config (argv). At any given time, there is at most one Source for a
 // given path.
 func (sm *SourceMap) NewReader(path string, c *Config) *SourceReader {
+	return sm.NewClientReader(path, c, "")
+}
+
+// NewClientReader is like NewReader, but labels the reader with the
+// given client address in log messages.
+func (sm *SourceMap) NewClientReader(path string, c *Config, client string) *SourceReader {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 	var src *Source
 	var ok bool
 	if src, ok = sm.sources[path]; !ok {
 		src = NewSource(path, c, sm)
+		src.stopping = sm.stopping
 		sm.sources[path] = src
 		go src.run()
 	}
-	return src.NewReader()
+	return src.NewReader(client)
 }
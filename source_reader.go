@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"log"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // SourceReader reads data from a Source. Every Read() call either
 // reads exactly one complete frame, or returns an error.
+//
+// SourceReader also implements io.WriterTo, which delivers frames
+// without copying them, so io.Copy(w, sourceReader) is cheaper than
+// calling Read in a loop.
+//
+// The reader updates nextFrame, FramesRead, FramesSkipped, and
+// BytesRead atomically, so other goroutines can load them (e.g., to
+// log stats) while it reads.
 type SourceReader struct {
+	ID         uint64 // unique among all clients of this process
 	source     *Source
 	didHeader  bool
 	nextFrame  uint64
@@ -18,73 +31,322 @@ type SourceReader struct {
 	// was never returned by Read().
 	FramesSkipped uint64
 	BytesRead     uint64
+	startTime     time.Time
+	client        string
+	// FramesSkipped as of the last periodic logStats() call
+	loggedSkipped uint64
+	kicked        int32         // see Kick
+	expires       time.Time     // end of session, or zero for unlimited
+	expiryTimer   *time.Timer   // wakes the reader when the session expires
+	maxBytes      uint64        // overrides source's clientMaxBytes, if > 0
+	maxStreamTime time.Duration // stop after this much media time, if > 0
+	streamTime    time.Duration // media time delivered so far
+	// Frames evicted from the ring buffer before this reader
+	// read them (only used with the "queue" slow client policy)
+	queue     []*frame
+	queueFull bool
+	queueLock sync.Mutex
+	// Header already sent to the client, to be compared with the
+	// header of the source it moved to (see moveTo)
+	sentHeader  []byte
+	checkHeader bool
 }
 
+var lastClientID uint64
+
 // ErrBufferTooSmall is returned if Read is called with a buffer
 // smaller than the source's next frame.
 var ErrBufferTooSmall = errors.New("caller's buffer is too small")
 
+// ErrKicked is returned by Read after the reader has been
+// disconnected by Kick.
+var ErrKicked = errors.New("disconnected by admin")
+
+// ErrHeaderChanged is returned by Read if the reader's source was
+// replaced after a config reload, and the new source's header differs
+// from the one the client has already received.
+var ErrHeaderChanged = errors.New("source header changed")
+
+// Read copies the next frame into buf. If the source has a header,
+// the first Read returns the header instead.
 func (sr *SourceReader) Read(buf []byte) (int, error) {
-	// We avoid doing more locking than absolutely necessary here,
-	// which causes some edge cases: it's possible for s.nextFrame
-	// to advance and even lap *nextFrame while we're deciding
-	// which frame to grab. However, since s.nextFrame never moves
-	// backward, the two worst cases are: [1] we grab a frame
-	// after computing nSkipped and then being lapped again, which
-	// means nSkipped underestimates the distance between the
-	// requested and actual frame (but this will be made up next
-	// time around), and [2] we grab a frame after s.nextFrame has
-	// advanced _to_ that frame, which means readNextFrame() will
-	// block while we copy the frame (but that's no worse than
-	// blocking _every_ readNextFrame, which would happen if we
-	// held a lock on s.nextFrame here).
-	s := sr.source
 	if !sr.didHeader {
 		sr.didHeader = true
 		if sr.source.HeaderBytes > 0 {
 			return sr.source.GetHeader(buf)
 		}
 	}
-	if s.clientMaxBytes > 0 && sr.BytesRead >= s.clientMaxBytes {
-		return 0, io.EOF
-	}
-	if s.nextFrame > uint64(0) && sr.nextFrame == uint64(0) {
-		// New clients start out reading fresh frames.
-		sr.nextFrame = s.nextFrame - uint64(1)
-	} else if s.nextFrame >= sr.nextFrame+uint64(cap(s.frames)) {
-		// s.nextFrame has lapped sr.nextFrame. Catch up.
-		delta := s.nextFrame - sr.nextFrame - uint64(1)
-		sr.FramesSkipped += delta
-		sr.nextFrame += delta
-	} else if sr.nextFrame >= s.nextFrame {
-		// Client has caught up to source. Includes "both are at zero" case.
-		s.Cond.L.Lock()
-		for sr.nextFrame >= s.nextFrame && !s.gone {
-			s.Cond.Wait()
+	f, err := sr.nextFrameRef(true)
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
+	if len(buf) < len(f.data) {
+		return 0, ErrBufferTooSmall
+	}
+	sr.advance(f)
+	return copy(buf, f.data), nil
+}
+
+// WriteTo writes the source's header (if any) and frames to w until
+// the source ends, the reader is stopped, or w returns an error.
+// Frames are written directly from the source's buffer, without
+// copying.
+//
+// If w has a Flush() method, WriteTo calls it whenever the reader
+// has caught up with the source, i.e., before waiting for the next
+// frame to arrive.
+func (sr *SourceReader) WriteTo(w io.Writer) (n int64, err error) {
+	if !sr.didHeader {
+		sr.didHeader = true
+		var header []byte
+		if header, err = sr.source.getHeader(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		} else if header != nil {
+			nw, err := w.Write(header)
+			n += int64(nw)
+			atomic.AddUint64(&sr.source.statBytesOut, uint64(nw))
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	for {
+		var f *frame
+		if f, err = sr.nextFrameRef(true); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return
+		}
+		sr.advance(f)
+		nw, err := w.Write(f.data)
+		f.release()
+		n += int64(nw)
+		if err != nil {
+			return n, err
 		}
-		s.Cond.L.Unlock()
-		if sr.nextFrame >= s.nextFrame {
-			// source is gone _and_ there are no more full frames in the buffer.
-			return 0, io.EOF
+		if fl, ok := w.(interface{ Flush() }); ok && sr.nextFrame >= atomic.LoadUint64(&sr.source.nextFrame) {
+			fl.Flush()
 		}
 	}
-	bufPos := sr.nextFrame % uint64(cap(s.frames))
-	s.frameLocks[bufPos].RLock()
-	defer s.frameLocks[bufPos].RUnlock()
-	frameSize := len(s.frames[bufPos])
-	if len(buf) < frameSize {
-		return 0, ErrBufferTooSmall
+}
+
+// advance records that f has been delivered to the client.
+func (sr *SourceReader) advance(f *frame) {
+	atomic.AddUint64(&sr.source.statBytesOut, uint64(len(f.data)))
+	atomic.StoreUint64(&sr.nextFrame, f.seq+1)
+	atomic.AddUint64(&sr.FramesRead, 1)
+	atomic.AddUint64(&sr.BytesRead, uint64(len(f.data)))
+	sr.streamTime += f.duration
+}
+
+// unread undoes advance(f), for a frame that turned out not to be
+// delivered. Frames must be unread in reverse order.
+func (sr *SourceReader) unread(f *frame) {
+	atomic.AddUint64(&sr.source.statBytesOut, -uint64(len(f.data)))
+	sr.requeue(f)
+	atomic.StoreUint64(&sr.nextFrame, f.seq)
+	atomic.AddUint64(&sr.FramesRead, ^uint64(0))
+	atomic.AddUint64(&sr.BytesRead, -uint64(len(f.data)))
+	sr.streamTime -= f.duration
+}
+
+// nextFrameRef waits for the next frame this reader should receive,
+// and returns it with a reference held. The caller must release it.
+//
+// If block is false and the reader has caught up with the source,
+// nextFrameRef returns a nil frame and a nil error instead of
+// waiting.
+func (sr *SourceReader) nextFrameRef(block bool) (*frame, error) {
+	// We avoid doing more locking than absolutely necessary here,
+	// which causes some edge cases: it's possible for s.nextFrame
+	// to advance and even lap *nextFrame while we're deciding
+	// which frame to grab. Since s.nextFrame never moves
+	// backward, and ring.get() refuses to return a frame that has
+	// been replaced, the worst case is that we find our frame
+	// has been overwritten and try again, which means nSkipped
+	// is computed using the newer value of s.nextFrame.
+	s := sr.source
+	if sr.isKicked() {
+		return nil, ErrKicked
+	}
+	if s.stopping {
+		return nil, io.EOF
+	}
+	if !sr.expires.IsZero() {
+		if sr.expired() {
+			return nil, ErrSessionExpired
+		}
+		if sr.expiryTimer == nil {
+			// Don't keep waiting for a frame on a quiet
+			// source after the session expires.
+			sr.expiryTimer = time.AfterFunc(time.Until(sr.expires), sr.wake)
+		}
+	}
+	maxBytes := s.clientMaxBytes
+	if sr.maxBytes > 0 {
+		maxBytes = sr.maxBytes
+	}
+	if maxBytes > 0 && sr.BytesRead >= maxBytes {
+		return nil, io.EOF
+	}
+	if sr.maxStreamTime > 0 && sr.streamTime >= sr.maxStreamTime {
+		return nil, io.EOF
+	}
+	for {
+		if f, err := sr.nextQueued(); f != nil || err != nil {
+			return f, err
+		}
+		sNext := atomic.LoadUint64(&s.nextFrame)
+		if sNext > uint64(0) && sr.checkHeader {
+			// The source read its header before its first
+			// frame, so getHeader won't block.
+			if header, _ := s.getHeader(); !bytes.Equal(header, sr.sentHeader) {
+				return nil, ErrHeaderChanged
+			}
+			sr.checkHeader, sr.sentHeader = false, nil
+		}
+		if sNext > uint64(0) && sr.nextFrame == uint64(0) {
+			// New clients start out reading fresh frames.
+			atomic.StoreUint64(&sr.nextFrame, sNext-uint64(1))
+		} else if sNext >= sr.nextFrame+uint64(s.ring.Len()) {
+			// s.nextFrame has lapped sr.nextFrame. Catch up,
+			// if the slow client policy allows it.
+			if s.slowPolicy == policyQueue {
+				// Our frame might not have been
+				// evicted yet. If it has, it was
+				// queued before s.nextFrame advanced.
+				if f := s.ring.get(sr.nextFrame); f != nil {
+					return f, nil
+				} else if f, err := sr.nextQueued(); f != nil || err != nil {
+					return f, err
+				}
+			}
+			delta := sNext - sr.nextFrame - uint64(1)
+			if err := sr.checkSkip(delta); err != nil {
+				return nil, err
+			}
+			atomic.AddUint64(&sr.FramesSkipped, delta)
+			atomic.AddUint64(&sr.nextFrame, delta)
+		} else if sr.nextFrame >= sNext {
+			// Client has caught up to source. Includes "both are at zero" case.
+			s.Cond.L.Lock()
+			for block && sr.nextFrame >= s.nextFrame && !s.gone && !sr.isKicked() && !s.stopping && !sr.expired() {
+				s.Cond.Wait()
+			}
+			s.Cond.L.Unlock()
+			if sr.isKicked() {
+				return nil, ErrKicked
+			} else if sr.expired() {
+				return nil, ErrSessionExpired
+			} else if s.stopping {
+				return nil, io.EOF
+			} else if sr.nextFrame >= s.nextFrame && s.successor != nil {
+				// source was replaced after a config reload,
+				// and we have read all of its frames.
+				sr.moveTo(s.successor)
+				return sr.nextFrameRef(block)
+			} else if sr.nextFrame >= s.nextFrame && s.gone {
+				// source is gone _and_ there are no more full frames in the buffer.
+				return nil, io.EOF
+			} else if sr.nextFrame >= s.nextFrame {
+				// !block, and no new frames yet.
+				return nil, nil
+			}
+		}
+		if f := s.ring.get(sr.nextFrame); f != nil {
+			if err := sr.checkLag(f); err != nil {
+				f.release()
+				return nil, err
+			}
+			return f, nil
+		}
+		// Our frame was overwritten while we were looking
+		// at it. Catch up next time around.
 	}
-	copy(buf, s.frames[bufPos])
-	atomic.AddUint64(&s.statBytesOut, uint64(frameSize))
-	sr.nextFrame++
-	sr.FramesRead++
-	sr.BytesRead += uint64(frameSize)
-	return len(s.frames[bufPos]), nil
 }
 
 // Close disconnects the reader from the source. Unclosed
 // SourceReaders can cause Sources to stay open needlessly.
 func (sr *SourceReader) Close() {
-	sr.source.Done()
+	if sr.expiryTimer != nil {
+		sr.expiryTimer.Stop()
+	}
+	sr.releaseQueue()
+	sr.source.observeClient(sr)
+	sr.source.Done(sr)
+}
+
+// Kick makes the reader's next (or current) Read call return
+// ErrKicked, so the client is disconnected at a frame boundary.
+func (sr *SourceReader) Kick() {
+	s := sr.source
+	// Hold the write lock, so a reader that is about to wait
+	// (holding the read lock) doesn't miss the broadcast.
+	s.Lock()
+	atomic.StoreInt32(&sr.kicked, 1)
+	s.Unlock()
+	s.Cond.Broadcast()
+	s.wakePool()
+}
+
+func (sr *SourceReader) isKicked() bool {
+	return atomic.LoadInt32(&sr.kicked) != 0
+}
+
+// expired returns true if the reader's session has expired.
+func (sr *SourceReader) expired() bool {
+	return !sr.expires.IsZero() && time.Now().After(sr.expires)
+}
+
+// wake makes the reader recheck its session expiry, if it is
+// waiting for a frame.
+func (sr *SourceReader) wake() {
+	s := sr.source
+	// Like Kick, wait for a reader that is about to wait (holding
+	// the read lock) to start waiting, so it doesn't miss the
+	// broadcast.
+	s.Lock()
+	s.Unlock()
+	s.Cond.Broadcast()
+	s.wakePool()
+}
+
+// moveTo detaches the reader from its current source and attaches it
+// to the given source, starting at that source's next frame. If the
+// client has received a header, nextFrameRef checks it against the new
+// source's header before returning the new source's first frame.
+func (sr *SourceReader) moveTo(s *Source) {
+	old := sr.source
+	if sr.didHeader && (old.HeaderBytes > 0 || s.HeaderBytes > 0) {
+		sr.sentHeader, _ = old.getHeader()
+		sr.checkHeader = true
+	}
+	s.addReader(sr)
+	sr.source = s
+	atomic.StoreUint64(&sr.nextFrame, 0)
+	old.Done(sr)
+}
+
+// Lag returns the number of frames the source has produced that the
+// reader has not yet caught up with.
+func (sr *SourceReader) Lag() uint64 {
+	next, sNext := atomic.LoadUint64(&sr.nextFrame), atomic.LoadUint64(&sr.source.nextFrame)
+	if next == 0 || next >= sNext {
+		return 0
+	}
+	return sNext - next
+}
+
+// logStats logs the reader's statistics. If periodic is true, the
+// next call counts skipped frames from now.
+func (sr *SourceReader) logStats(periodic bool) {
+	skipped := atomic.LoadUint64(&sr.FramesSkipped)
+	log.Printf("client %s stats: %d bytes, %d frames, %d skipped (%d since last log), %d frames lag, %v elapsed", sr.client, atomic.LoadUint64(&sr.BytesRead), atomic.LoadUint64(&sr.FramesRead), skipped, skipped-atomic.LoadUint64(&sr.loggedSkipped), sr.Lag(), time.Since(sr.startTime))
+	if periodic {
+		atomic.StoreUint64(&sr.loggedSkipped, skipped)
+	}
 }
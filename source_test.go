@@ -6,10 +6,12 @@ import (
 	"hash/crc64"
 	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -381,6 +383,55 @@ func TestBandwidth(t *testing.T) {
 	})
 }
 
+func TestRealtimeRaw(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader("/dev/zero", &Config{
+		SourceBuffer: 16,
+		FrameBytes:   1600,
+		CloseIdle:    true,
+		RawByteRate:  160000,
+		Realtime:     true,
+	})
+	defer rdr.Close()
+	frame := make([]byte, 1600)
+	t0 := time.Now()
+	for i := 0; i < 50; i++ {
+		if _, err := rdr.Read(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 50 frames of 10ms each
+	if elapsed := time.Since(t0); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("read 500ms of media in %s", elapsed)
+	}
+}
+
+func TestRealtimeMp3File(t *testing.T) {
+	// 40 frames of 1152 samples at 44100 Hz = ~1.04s
+	fn := writeTestFile(t, bytes.Repeat(testMp3Frame(), 40))
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewReader(fn, &Config{
+		SourceBuffer: 100,
+		FrameBytes:   2048,
+		FrameFilter:  "mp3",
+		CloseIdle:    true,
+		Realtime:     true,
+	})
+	defer rdr.Close()
+	t0 := time.Now()
+	n, err := io.Copy(ioutil.Discard, rdr)
+	if err != nil {
+		t.Error(err)
+	}
+	elapsed := time.Since(t0)
+	t.Logf("read %d bytes in %s", n, elapsed)
+	if elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read ~1s of media in %s", elapsed)
+	}
+}
+
 func doBandwidthTests(t *testing.T, config *Config) {
 	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(runtime.NumCPU()))
 	for _, bw := range []uint64{100000, 1000000} {
@@ -587,3 +638,91 @@ func consume(b *testing.B, rdr *SourceReader, label interface{}) {
 		}
 	}
 }
+
+func TestLogClientStats(t *testing.T) {
+	logbuf := &bytes.Buffer{}
+	log.SetOutput(logbuf)
+	defer log.SetOutput(os.Stderr)
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewClientReader("/dev/zero", &Config{
+		SourceBuffer: 5,
+		FrameBytes:   16,
+		CloseIdle:    true,
+	}, "1.2.3.4:5678")
+	defer rdr.Close()
+	frame := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		if _, err := rdr.Read(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rdr.source.LogStats()
+	if !bytes.Contains(logbuf.Bytes(), []byte("client 1.2.3.4:5678 stats: 48 bytes, 3 frames")) {
+		t.Errorf("client stats not logged: %q", logbuf.String())
+	}
+	// Only periodic logs reset the "since last log" count.
+	sr := &SourceReader{source: rdr.source, client: "1.2.3.4:5678", FramesSkipped: 5}
+	for _, trial := range []struct {
+		periodic bool
+		expect   string
+	}{
+		{false, "5 skipped (5 since last log)"},
+		{true, "5 skipped (5 since last log)"},
+		{false, "5 skipped (0 since last log)"},
+	} {
+		logbuf.Reset()
+		sr.logStats(trial.periodic)
+		if !strings.Contains(logbuf.String(), trial.expect) {
+			t.Errorf("periodic=%v: expected %q, got %q", trial.periodic, trial.expect, logbuf.String())
+		}
+	}
+}
+
+// Log client stats periodically, while the client reads.
+func TestLogClientStatsWhileReading(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	sm := NewSourceMap()
+	defer sm.Close()
+	rdr := sm.NewClientReader("/dev/zero", &Config{
+		ClientStatLogInterval: time.Millisecond,
+		SourceBuffer:          5,
+		FrameBytes:            16,
+		CloseIdle:             true,
+	}, "1.2.3.4:5678")
+	defer rdr.Close()
+	frame := make([]byte, 16)
+	for t0 := time.Now(); time.Since(t0) < 50*time.Millisecond; {
+		if _, err := rdr.Read(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChildKillDelay(t *testing.T) {
+	for _, trap := range []string{"exit 0", ""} {
+		sm := NewSourceMap()
+		rdr := sm.NewReader("", &Config{
+			SourceBuffer:   5,
+			FrameBytes:     1,
+			CloseIdle:      true,
+			Reopen:         false,
+			ExecFlag:       true,
+			ChildKillDelay: 300 * time.Millisecond,
+			Args:           []string{"sh", "-c", "trap '" + trap + "' TERM; echo -n x; while :; do sleep .01; done"},
+		})
+		if _, err := rdr.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		t0 := time.Now()
+		rdr.Close()
+		elapsed := time.Since(t0)
+		if trap == "" && elapsed < 300*time.Millisecond {
+			t.Errorf("child ignoring SIGTERM was killed after %v", elapsed)
+		} else if trap != "" && elapsed > 200*time.Millisecond {
+			t.Errorf("child exiting on SIGTERM took %v to stop", elapsed)
+		}
+		sm.Close()
+	}
+}
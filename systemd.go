@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+// socket activation (SD_LISTEN_FDS_START).
+var listenFDsStart = 3
+
+// systemdListener returns the listening socket passed by systemd
+// socket activation, or nil if there isn't one. It unsets the
+// LISTEN_* environment variables, so child processes don't think
+// the socket is meant for them.
+func systemdListener() (*net.TCPListener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS=%q: no sockets", fds)
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets; using the first one", n)
+	}
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_"+strconv.Itoa(listenFDsStart))
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %s", err)
+	}
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, errors.New("systemd socket is not a TCP socket")
+	}
+	log.Printf("using socket %s from systemd (ignoring -address)", tcp.Addr())
+	return tcp, nil
+}
+
+// sdNotify sends a notification (like "READY=1") to systemd, if
+// NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	if strings.HasPrefix(sock, "@") {
+		// Abstract socket
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to send WATCHDOG=1 to systemd:
+// half of WatchdogSec, or 0 if the watchdog isn't enabled for this
+// process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog sends WATCHDOG=1 to systemd every interval, as long as
+// the server is healthy, until the server stops. If the server
+// isn't healthy, systemd restarts it.
+func (srv *Server) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.stateLock.RLock()
+		done := srv.done
+		srv.stateLock.RUnlock()
+		if done {
+			return
+		}
+		if err := srv.sourceMap.Healthy(); err != nil {
+			log.Printf("watchdog: %s", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("watchdog: %s", err)
+		}
+	}
+}
+
+// detectsFailure returns true if any of c's sources (or mounts) can
+// be marked as failed, i.e., -restart-fail-count is set.
+func (c *Config) detectsFailure() bool {
+	if len(c.Mounts) == 0 {
+		return c.RestartFailCount > 0
+	}
+	for _, mc := range c.Mounts {
+		if mc.RestartFailCount > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Healthy returns an error if the sources aren't working: if every
+// open source has failed. Sources never fail unless
+// -restart-fail-count is set, and no open sources counts as healthy.
+// It blocks (and the watchdog stops) if the source map is
+// deadlocked.
+func (sm *SourceMap) Healthy() error {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	failed := 0
+	for _, src := range sm.sources {
+		if src.isFailed() {
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(sm.sources) {
+		return fmt.Errorf("all %d sources failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a NOTIFY_SOCKET for the duration of the
+// test, and returns a channel of received notifications.
+func notifySocket(t *testing.T) chan string {
+	dir, err := ioutil.TempDir("", "streamserve-notify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: fn, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	})
+	t.Setenv("NOTIFY_SOCKET", fn)
+	msgs := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func expectNotify(t *testing.T, msgs chan string, expect string) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			if msg == expect {
+				return
+			}
+		case <-timeout:
+			t.Errorf("did not get %q", expect)
+			return
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %s", err)
+	}
+	msgs := notifySocket(t)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	expectNotify(t, msgs, "READY=1")
+}
+
+func TestSystemdListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Pass a copy of the socket, as systemd would.
+	raw, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dup int
+	raw.Control(func(fd uintptr) {
+		dup, err = syscall.Dup(int(fd))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFDsStart = start }(listenFDsStart)
+	listenFDsStart = dup
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	msgs := notifySocket(t)
+	srv := &Server{}
+	err = srv.Run(&Config{
+		Addr:         "127.0.0.1:1",
+		FrameBytes:   16,
+		Path:         "/dev/zero",
+		Reopen:       true,
+		SourceBuffer: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr != ln.Addr().String() {
+		t.Errorf("listening at %s, expected %s", srv.Addr, ln.Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS was not unset")
+	}
+	expectNotify(t, msgs, "READY=1")
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.Close()
+	expectNotify(t, msgs, "STOPPING=1")
+}
+
+func TestWatchdog(t *testing.T) {
+	msgs := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:         ":0",
+		FrameBytes:   16,
+		Path:         "/dev/zero",
+		Reopen:       true,
+		SourceBuffer: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	expectNotify(t, msgs, "READY=1")
+	expectNotify(t, msgs, "WATCHDOG=1")
+	t.Setenv("WATCHDOG_PID", "1")
+	if watchdogInterval() != 0 {
+		t.Error("watchdog enabled for another process")
+	}
+}
+
+func TestSourceMapHealthy(t *testing.T) {
+	sm := NewSourceMap()
+	defer sm.Close()
+	if err := sm.Healthy(); err != nil {
+		t.Errorf("no sources: %s", err)
+	}
+	rdr := sm.NewReader("/stream", crashLoopConfig())
+	defer rdr.Close()
+	for t0 := time.Now(); !sm.Failed("/stream"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("source did not fail")
+		}
+	}
+	if err := sm.Healthy(); err == nil {
+		t.Error("expected error when all sources failed")
+	}
+}
+
+func TestDetectsFailure(t *testing.T) {
+	for _, c := range []struct {
+		c    *Config
+		want bool
+	}{
+		{&Config{}, false},
+		{&Config{RestartFailCount: 3}, true},
+		{&Config{RestartFailCount: 3, Mounts: map[string]*Config{"/a": {}}}, false},
+		{&Config{Mounts: map[string]*Config{"/a": {}, "/b": {RestartFailCount: 3}}}, true},
+	} {
+		if got := c.c.detectsFailure(); got != c.want {
+			t.Errorf("%+v: got %v, want %v", c.c, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A connectEvent is posted to -auth-webhook before a client is
+// started.
+type connectEvent struct {
+	Event      string      `json:"event"` // "connect"
+	RemoteAddr string      `json:"remote-addr"`
+	IP         string      `json:"ip"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query"`
+	Headers    http.Header `json:"headers"`
+}
+
+// A webhookReply is the webhook's response to a connectEvent.
+type webhookReply struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+	// Opaque value, returned to the webhook on disconnect
+	Session string `json:"session"`
+	// Override -client-max-bytes, -client-max-duration, and
+	// -client-max-stream-time, if given
+	MaxBytes      uint64 `json:"max-bytes"`
+	MaxSession    string `json:"max-session"`
+	MaxStreamTime string `json:"max-stream-time"`
+	limits        clientLimits
+}
+
+// A disconnectEvent is posted to -auth-webhook after a client
+// (which was allowed by the webhook) disconnects.
+type disconnectEvent struct {
+	Event         string  `json:"event"` // "disconnect"
+	Session       string  `json:"session"`
+	Client        uint64  `json:"client"`
+	RemoteAddr    string  `json:"remote-addr"`
+	Path          string  `json:"path"`
+	Bytes         int64   `json:"bytes"`
+	FramesRead    uint64  `json:"frames-read"`
+	FramesSkipped uint64  `json:"frames-skipped"`
+	Seconds       float64 `json:"seconds"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// newWebhookClient returns an http client for -auth-webhook, which
+// connects to -auth-webhook-socket instead of the URL's host if a
+// socket is given.
+func newWebhookClient(c *Config) *http.Client {
+	client := &http.Client{Timeout: c.AuthWebhookTimeout}
+	if c.AuthWebhookSocket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.AuthWebhookSocket)
+			},
+		}
+	}
+	return client
+}
+
+// postWebhook posts msg to the webhook URL, and decodes the response
+// into reply (if reply is not nil).
+func (srv *Server) postWebhook(url string, msg, reply interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := srv.webhookClient.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	if reply == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return fmt.Errorf("webhook: %s", err)
+	}
+	return nil
+}
+
+// webhookConnect asks mc's webhook whether the client making req
+// should be started. If the webhook fails, the client is refused
+// with 503; if the webhook denies the client, it is refused with
+// 403.
+func (srv *Server) webhookConnect(mc *Config, req *http.Request) (*webhookReply, error) {
+	msg := &connectEvent{
+		Event:      "connect",
+		RemoteAddr: req.RemoteAddr,
+		Path:       req.URL.Path,
+		Query:      req.URL.RawQuery,
+		Headers:    req.Header,
+	}
+	if ip := remoteIP(req.RemoteAddr); ip != nil {
+		msg.IP = ip.String()
+	}
+	reply := &webhookReply{}
+	if err := srv.postWebhook(mc.AuthWebhook, msg, reply); err != nil {
+		return nil, &authError{http.StatusServiceUnavailable, err.Error()}
+	}
+	if !reply.Allow {
+		reason := reply.Reason
+		if reason == "" {
+			reason = "denied by webhook"
+		}
+		return nil, &authError{http.StatusForbidden, reason}
+	}
+	reply.limits.maxBytes = reply.MaxBytes
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"max-session", reply.MaxSession, &reply.limits.maxDuration},
+		{"max-stream-time", reply.MaxStreamTime, &reply.limits.maxStreamTime},
+	} {
+		if d.value == "" {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.value); err != nil {
+			return nil, &authError{http.StatusServiceUnavailable, "webhook: " + d.name + ": " + err.Error()}
+		}
+	}
+	return reply, nil
+}
+
+// webhookDisconnect notifies mc's webhook that a client has
+// disconnected. It doesn't wait for the webhook to respond.
+func (srv *Server) webhookDisconnect(mc *Config, msg *disconnectEvent) {
+	msg.Event = "disconnect"
+	srv.webhooks.Add(1)
+	go func() {
+		defer srv.webhooks.Done()
+		if err := srv.postWebhook(mc.AuthWebhook, msg, nil); err != nil {
+			log.Printf("client %s disconnect webhook: %s", msg.RemoteAddr, err)
+		}
+	}()
+}
+
+// waitWebhooks waits for pending disconnect notifications, or for
+// ctx to be done.
+func (srv *Server) waitWebhooks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		srv.webhooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testWebhook allows clients with "?ok" in the query (limiting them
+// to 1600 bytes), and sends disconnect events to the returned
+// channel.
+func testWebhook(t *testing.T) (http.Handler, chan *disconnectEvent) {
+	disconnects := make(chan *disconnectEvent, 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ev map[string]interface{}
+		buf, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(buf, &ev); err != nil {
+			t.Error(err)
+			return
+		}
+		switch ev["event"] {
+		case "connect":
+			if ev["query"] != "ok" {
+				json.NewEncoder(w).Encode(&webhookReply{Reason: "no ok"})
+				return
+			}
+			json.NewEncoder(w).Encode(&webhookReply{Allow: true, Session: "s1", MaxBytes: 1600})
+		case "disconnect":
+			var dis disconnectEvent
+			json.Unmarshal(buf, &dis)
+			disconnects <- &dis
+		default:
+			t.Errorf("unexpected event %q", ev["event"])
+		}
+	}), disconnects
+}
+
+func testWebhookServer(t *testing.T, c *Config, disconnects chan *disconnectEvent) {
+	c.Addr = ":0"
+	c.FrameBytes = 16
+	c.Path = "/dev/zero"
+	c.Reopen = true
+	c.SourceBuffer = 4
+	srv := &Server{}
+	if err := srv.Run(c); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("http://%s/", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %s", resp.Status)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://%s/?ok", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || n != 1600 {
+		t.Errorf("expected 1600 bytes, got %d, %v", n, err)
+	}
+	select {
+	case dis := <-disconnects:
+		if dis.Session != "s1" || dis.Bytes != 1600 || dis.FramesRead != 100 || dis.Path != "/" {
+			t.Errorf("unexpected disconnect event %+v", dis)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no disconnect event")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	h, disconnects := testWebhook(t)
+	hook := httptest.NewServer(h)
+	defer hook.Close()
+	testWebhookServer(t, &Config{AuthWebhook: hook.URL}, disconnects)
+}
+
+func TestWebhookSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamserve-webhook-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, disconnects := testWebhook(t)
+	go http.Serve(ln, h)
+	defer ln.Close()
+	testWebhookServer(t, &Config{AuthWebhook: "http://webhook/auth", AuthWebhookSocket: sock}, disconnects)
+}
+
+func TestWebhookDown(t *testing.T) {
+	hook := httptest.NewServer(http.NotFoundHandler())
+	defer hook.Close()
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:         ":0",
+		AuthWebhook:  hook.URL,
+		FrameBytes:   16,
+		Path:         "/dev/zero",
+		Reopen:       true,
+		SourceBuffer: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	resp, err := http.Get(fmt.Sprintf("http://%s/?ok", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %s", resp.Status)
+	}
+}
+
+func TestWebhookCantExtendToken(t *testing.T) {
+	fn := writeAuthKeys(t, `{"tokens":[{"token":"abc","max-session":"1s"}]}`)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(&webhookReply{Allow: true, MaxSession: "1h"})
+	}))
+	defer hook.Close()
+	srv := &Server{}
+	err := srv.Run(&Config{
+		Addr:            ":0",
+		AuthKeyFile:     fn,
+		AuthWebhook:     hook.URL,
+		FrameBytes:      16,
+		Path:            "/dev/zero",
+		Reopen:          true,
+		RequireAuth:     true,
+		SourceBandwidth: 16000,
+		SourceBuffer:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/", srv.Addr), nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	t0 := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(t0); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("response ended after %s, expected 1s", elapsed)
+	}
+}